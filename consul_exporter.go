@@ -1,231 +1,2595 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
+	"errors"
 	"flag"
+	"fmt"
+	"html"
+	"math"
+	"net"
 	"net/http"
-	_ "net/http/pprof"
+	"net/http/pprof"
+	"os"
+	"os/signal"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/log"
+	versioncollector "github.com/prometheus/client_golang/prometheus/collectors/version"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/promlog"
+	"github.com/prometheus/common/version"
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
 
 	consul_api "github.com/hashicorp/consul/api"
-	consul "github.com/hashicorp/consul/consul/structs"
 )
 
 const (
-	namespace = "consul"
+	defaultNamespace = "consul"
+
+	// Blocking queries return after watchWaitTime at the latest, which also
+	// refreshes the metrics that aren't watched.
+	watchWaitTime = time.Minute
+	// Bursts of changes are folded into one refresh per watchMinInterval.
+	watchMinInterval = time.Second
+	watchMinBackoff  = time.Second
+	watchMaxBackoff  = time.Minute
+
+	// kvInfoMaxValueLength bounds the value label of consul_kv_info.
+	kvInfoMaxValueLength = 256
+
+	// An exporter whose datacenter couldn't be looked up at startup tries
+	// again every datacenterRetryInterval.
+	datacenterRetryInterval = 5 * time.Second
 )
 
+// agentMetricsRegistry holds the agentMetricsCollector of each exporter
+// registered with the default registry.
+var agentMetricsRegistry = prometheus.NewRegistry()
+
+// errNoDatacenter is returned by NewExporter when the datacenter to report
+// isn't set and the agent couldn't tell its own.
+var errNoDatacenter = errors.New("could not look up the agent's datacenter, consider setting -consul.datacenter")
+
 var (
 	serviceLabelNames = []string{"service", "node"}
 	memberLabelNames  = []string{"member"}
+
+	// healthStatuses lists every value of the status label, ordered from
+	// least to most severe.
+	healthStatuses = []string{
+		consul_api.HealthPassing,
+		consul_api.HealthWarning,
+		consul_api.HealthCritical,
+		consul_api.HealthMaint,
+	}
+
+	// gatewayKinds lists every value of the kind label of mesh_gateways.
+	gatewayKinds = []consul_api.ServiceKind{
+		consul_api.ServiceKindMeshGateway,
+		consul_api.ServiceKindIngressGateway,
+		consul_api.ServiceKindTerminatingGateway,
+	}
 )
 
+// consulOpts holds the settings used to connect to the Consul HTTP API.
+type consulOpts struct {
+	uri             string
+	scheme          string
+	token           string
+	managementToken string
+	caFile          string
+	certFile        string
+	keyFile         string
+	insecure        bool
+	timeout         time.Duration
+	cacheTTL        time.Duration
+	watch           bool
+	retries         int
+	retryInterval   time.Duration
+	userAgent       string
+	scrapeInterval  time.Duration
+
+	datacenter         string
+	namespace          string
+	partition          string
+	concurrentRequests int
+	allowStale         bool
+	requireConsistent  bool
+	maxIdleConns       int
+	rateLimit          float64
+	rateBurst          int
+}
+
+// exporterOpts holds the settings that control what the exporter exposes.
+type exporterOpts struct {
+	metricsNamespace string
+
+	collectKV               bool
+	collectServiceEntries   bool
+	collectServiceInstances bool
+	collectChecks           bool
+
+	kvPrefixes   stringsFlag
+	kvFilter     string
+	kvValueMap   string
+	kvParseMode  string
+	kvMode       string
+	kvMin, kvMax float64
+	exposeTags   bool
+
+	exposeCheckOutput        bool
+	exposeIntentions         bool
+	exposeCoordinates        bool
+	exposeRaftLag            bool
+	exposeAgentHealth        bool
+	exposeLicense            bool
+	exposeConnectTopology    bool
+	exposeDatacenters        bool
+	exposeDeregisterCritical bool
+	healthFromState          bool
+	warningAsHealthy         bool
+
+	serviceInclude string
+	serviceExclude string
+	nodes          string
+	checkStates    string
+
+	nodeLabel         string
+	nodeMetaLabels    string
+	serviceMetaLabels string
+
+	agentMetricPrefixes string
+}
+
+// stringsFlag is a flag.Value that collects every value of a repeated flag.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// checkKey identifies a health check across the cluster.
+type checkKey struct {
+	node, check string
+}
+
+// checkUpdate records when a revision of a health check was first seen.
+type checkUpdate struct {
+	modifyIndex uint64
+	seen        time.Time
+}
+
+// kvPrefix is a KV prefix to export, along with the filter its keys must match.
+type kvPrefix struct {
+	prefix string
+	filter *regexp.Regexp
+}
+
 // Exporter collects Consul stats from the given server and exports them using
 // the prometheus metrics package.
 type Exporter struct {
-	URI   string
+	URI string
+	// mutex guards what a refresh shares with Collect and the watches:
+	// results, lastRefresh, client and nodeIDs.
 	mutex sync.RWMutex
 
-	up, clusterServers                                 prometheus.Gauge
-	nodeCount, serviceCount                            prometheus.Counter
-	serviceNodesTotal, serviceNodesHealthy, nodeChecks, keyValues *prometheus.GaugeVec
-	client                                             *consul_api.Client
-	kvPrefix                                          string
-	kvFilter                                          *regexp.Regexp
+	up, clusterServers                                             prometheus.Gauge
+	nodeCount, wanMemberCount, serviceCount                        *prometheus.GaugeVec
+	catalogLastIndex, queryLastContact, queryKnownLeader           *prometheus.GaugeVec
+	serviceExists                                                  *prometheus.GaugeVec
+	scrapeDuration, lastScrapeError, cacheHit, refreshAge          prometheus.Gauge
+	rateLimitedTotal                                               prometheus.CounterFunc
+	serviceNodesTotal, serviceNodesHealthy, nodeChecks, keyValues  *prometheus.GaugeVec
+	kvInfo, kvUnparsable, kvKeys, kvFlags                          *prometheus.GaugeVec
+	kvListSuccess                                                  *prometheus.GaugeVec
+	serviceChecks, checkLastUpdate, nodeMetadata                   *prometheus.GaugeVec
+	deregisterCritical                                             *prometheus.GaugeVec
+	servicePort, serviceAddress, serviceWeight                     *prometheus.GaugeVec
+	serviceNodesStatus, serviceTags, serviceMetadata, querySuccess *prometheus.GaugeVec
+	serviceTagNodes, nodeServices, unhealthyInstances              *prometheus.GaugeVec
+	meshGateways, checksByType, healthChecks                       *prometheus.GaugeVec
+	nodeMaintenance, serviceMaintenance                            *prometheus.GaugeVec
+	raftLeader, memberStatus, nodeChecksFailing                    *prometheus.GaugeVec
+	autopilotHealthy, autopilotServerHealthy                       *prometheus.GaugeVec
+	raftLastContact, raftLastIndex                                 *prometheus.GaugeVec
+	raftConfigurationPeers                                         *prometheus.GaugeVec
+	sessions                                                       *prometheus.GaugeVec
+	preparedQueries, preparedQueryInfo                             *prometheus.GaugeVec
+	intentions, networkRTT, connectTopology                        *prometheus.GaugeVec
+	activeServer, agentServer, versionInfo                         *prometheus.GaugeVec
+	agentSelfHealthy, licenseExpiry                                *prometheus.GaugeVec
+	datacenterCount, datacenterReachable                           *prometheus.GaugeVec
+	scrapeErrors, retriesTotal, watchErrors                        *prometheus.CounterVec
+	watchConnected                                                 *prometheus.GaugeVec
+	queryDuration                                                  *prometheus.HistogramVec
+	client, agentClient                                            *consul_api.Client
+	servers                                                        []consulServer
+	kvPrefixes                                                     []kvPrefix
+	kvValueMap                                                     map[string]float64
+	kvParseMode                                                    string
+	kvInfoMode                                                     bool
+	kvMin, kvMax                                                   float64
+	exposeTags, exposeCheckOutput, healthFromState                 bool
+	exposeIntentions, exposeCoordinates, exposeRaftLag             bool
+	exposeAgentHealth, exposeDeregisterCritical, warningAsHealthy  bool
+	exposeLicense, exposeConnectTopology, exposeDatacenters        bool
+	checkUpdates                                                   map[checkKey]checkUpdate
+	criticalSince                                                  map[checkKey]time.Time
+	nodeLabelID                                                    bool
+	collectKV, collectServiceEntries, collectChecks                bool
+	collectServiceInstances                                        bool
+	nodeIDs                                                        map[string]string
+	serviceInclude, serviceExclude                                 *regexp.Regexp
+	nodes                                                          []string
+	checkStates                                                    map[string]bool
+	nodeMetaKeys, serviceMetaKeys                                  []string
+	agentMetricPrefixes                                            []string
+	metricsNamespace                                               string
+	agentMetrics                                                   []prometheus.Metric
+	constLabels                                                    prometheus.Labels
+	queryOptions                                                   consul_api.QueryOptions
+	managementToken                                                string
+	logger                                                         log.Logger
+	timeout                                                        time.Duration
+	concurrentRequests                                             int
+	retries                                                        int
+	retryInterval                                                  time.Duration
+
+	// The results of the scrape started at lastScrape are reused for cacheTTL.
+	cacheTTL   time.Duration
+	lastScrape time.Time
+	// background is set when Watch or ScrapeEvery keep the metrics up to
+	// date instead, and lastRefresh is when they last did.
+	background  bool
+	lastRefresh time.Time
+	// scrapeMutex serializes the scrapes that Collect runs itself.
+	scrapeMutex sync.Mutex
+	// results are what Collect delivers, swapped in by every refresh.
+	results results
+	// complete is set once the current scrape got through to Consul, and
+	// cleared again if it runs out of time.
+	complete bool
+
+	// datacenter is reported in the dc label. remote is set when it isn't
+	// the agent's own. The agent can only describe itself and its local
+	// pools, so those queries are left out.
+	datacenter string
+	remote     bool
+
+	// service is set when only the health of that service is queried and
+	// exported, for /metrics?service=.
+	service string
+
+	// ready is set once Consul has answered a query for the first time.
+	ready atomic.Bool
+	// queryFailed is set when any query of the current scrape fails.
+	queryFailed atomic.Bool
 }
 
-// NewExporter returns an initialized Exporter.
-func NewExporter(uri string, kvPrefix string, kvFilter string) *Exporter {
+// consulServer is one of the Consul servers or agents given to -consul.server.
+type consulServer struct {
+	address string
+	client  *consul_api.Client
+	// agentClient shares the connections of client, but gives up after
+	// -consul.timeout. It is for the API calls that take no context.
+	agentClient *consul_api.Client
+	// limiter is shared by the servers of an exporter.
+	limiter *rateLimiter
+}
+
+// newConsulServer sets up a client for the Consul API at address, or at the
+// address from the environment when it is empty.
+func newConsulServer(opts consulOpts, address string, limiter *rateLimiter) (consulServer, error) {
+	// Start from Consul's defaults so the usual CONSUL_HTTP_* environment
+	// variables are honored, then let explicitly set flags take precedence.
+	config := consul_api.DefaultConfig()
+	if address != "" {
+		config.Address = address
+	}
+	if opts.token != "" {
+		config.Token = opts.token
+	}
+	if opts.caFile != "" {
+		config.TLSConfig.CAFile = opts.caFile
+	}
+	if opts.certFile != "" {
+		config.TLSConfig.CertFile = opts.certFile
+	}
+	if opts.keyFile != "" {
+		config.TLSConfig.KeyFile = opts.keyFile
+	}
+	if opts.insecure {
+		config.TLSConfig.InsecureSkipVerify = true
+	}
+
+	// Talk HTTPS as soon as any TLS flag is given, unless told otherwise.
+	switch {
+	case opts.scheme != "":
+		config.Scheme = opts.scheme
+	case opts.caFile != "" || opts.certFile != "" || opts.keyFile != "" || opts.insecure:
+		config.Scheme = "https"
+	}
+
+	// Dial the agent's Unix socket ourselves rather than leaving it to the
+	// Consul client, which would discard our HTTP client to do so.
+	address = config.Address
+	if socket := strings.TrimPrefix(address, "unix://"); socket != address {
+		config.Transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+		config.Address = "localhost"
+	}
+
+	// Keep enough idle connections around to reuse them across scrapes.
+	if opts.maxIdleConns > 0 {
+		config.Transport.MaxIdleConns = opts.maxIdleConns
+		config.Transport.MaxIdleConnsPerHost = opts.maxIdleConns
+	}
+	httpClient, err := consul_api.NewHttpClient(config.Transport, config.TLSConfig)
+	if err != nil {
+		return consulServer{}, err
+	}
+	if opts.userAgent != "" {
+		httpClient.Transport = userAgentTransport{userAgent: opts.userAgent, next: httpClient.Transport}
+	}
+	if opts.rateLimit > 0 {
+		httpClient.Transport = rateLimitTransport{limiter: limiter, next: httpClient.Transport}
+	}
+	config.HttpClient = httpClient
+
 	// Set up our Consul client connection.
-	consul_client, _ := consul_api.NewClient(&consul_api.Config{
-		Address: uri,
-	})
+	client, err := consul_api.NewClient(config)
+	if err != nil {
+		return consulServer{}, err
+	}
+	config.HttpClient = &http.Client{Transport: httpClient.Transport, Timeout: opts.timeout}
+	agentClient, err := consul_api.NewClient(config)
+	if err != nil {
+		return consulServer{}, err
+	}
+	return consulServer{address: address, client: client, agentClient: agentClient, limiter: limiter}, nil
+}
+
+// userAgentTransport sets the User-Agent header of every request to Consul, so
+// that its logs tell the exporter's requests apart.
+type userAgentTransport struct {
+	userAgent string
+	next      http.RoundTripper
+}
+
+func (t userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Round trippers must not modify the request they were given.
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	return t.next.RoundTrip(req)
+}
+
+// rateLimiter holds back requests to Consul beyond -consul.rate-limit. The
+// clients of all the servers of an exporter share one.
+type rateLimiter struct {
+	limiter *rate.Limiter
+	// waits counts the requests that had to wait for their turn.
+	waits atomic.Uint64
+}
+
+// rateLimitTransport makes every request to Consul wait for its turn with
+// limiter.
+type rateLimitTransport struct {
+	limiter *rateLimiter
+	next    http.RoundTripper
+}
+
+func (t rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.limiter.limiter.Allow() {
+		t.limiter.waits.Add(1)
+		if err := t.limiter.limiter.Wait(req.Context()); err != nil {
+			return nil, err
+		}
+	}
+	return t.next.RoundTrip(req)
+}
+
+// NewExporter returns an initialized Exporter.
+func NewExporter(opts consulOpts, expOpts exporterOpts, logger log.Logger) (*Exporter, error) {
+	if opts.allowStale && opts.requireConsistent {
+		return nil, errors.New("only one of -consul.allow-stale and -consul.require-consistent may be set")
+	}
+	if opts.watch && opts.scrapeInterval > 0 {
+		return nil, errors.New("only one of -consul.watch and -consul.scrape-interval may be set")
+	}
+	if opts.timeout < 0 {
+		return nil, fmt.Errorf("-consul.timeout must not be negative, got %s", opts.timeout)
+	}
+
+	if opts.rateLimit > 0 && opts.rateBurst < 1 {
+		return nil, fmt.Errorf("-consul.rate-burst must be at least 1, got %d", opts.rateBurst)
+	}
+	limiter := &rateLimiter{limiter: rate.NewLimiter(rate.Limit(opts.rateLimit), opts.rateBurst)}
+
+	// Every server gets its own client, tried in order on each scrape.
+	var servers []consulServer
+	addresses := splitList(opts.uri)
+	if len(addresses) == 0 {
+		addresses = []string{""}
+	}
+	for _, address := range addresses {
+		server, err := newConsulServer(opts, address, limiter)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, server)
+	}
+
+	// Every metric carries the datacenter it was taken from. It is resolved
+	// once here so that the label stays the same for the process lifetime.
+	datacenter := opts.datacenter
+	remote := false
+	var self map[string]map[string]interface{}
+	var err error
+	for _, server := range servers {
+		if self, err = server.agentClient.Agent().Self(); err == nil {
+			break
+		}
+	}
+	switch {
+	case err == nil:
+		agentDatacenter, _ := self["Config"]["Datacenter"].(string)
+		if datacenter == "" {
+			datacenter = agentDatacenter
+		}
+		remote = datacenter != agentDatacenter
+	case datacenter == "":
+		return nil, fmt.Errorf("%w: %s", errNoDatacenter, err)
+	}
+	return newExporter(opts, expOpts, servers, datacenter, remote, logger)
+}
+
+// newExporter returns an Exporter that queries Consul through servers and
+// reports datacenter in the dc label.
+func newExporter(opts consulOpts, expOpts exporterOpts, servers []consulServer, datacenter string, remote bool, logger log.Logger) (*Exporter, error) {
+	namespace := expOpts.metricsNamespace
+	if !validNamespace.MatchString(namespace) {
+		return nil, fmt.Errorf("invalid metrics namespace %q", namespace)
+	}
+
+	var uris []string
+	for _, server := range servers {
+		uris = append(uris, server.address)
+	}
+
+	kvPrefixes, err := parseKVPrefixes(expOpts.kvPrefixes, expOpts.kvFilter)
+	if err != nil {
+		return nil, err
+	}
+
+	kvValueMap, err := parseValueMap(expOpts.kvValueMap)
+	if err != nil {
+		return nil, err
+	}
+	if expOpts.kvMode != "gauge" && expOpts.kvMode != "info" {
+		return nil, fmt.Errorf("invalid KV mode %q, expected gauge or info", expOpts.kvMode)
+	}
+	switch expOpts.kvParseMode {
+	case "float", "int", "auto":
+	default:
+		return nil, fmt.Errorf("invalid KV parse mode %q, expected float, int or auto", expOpts.kvParseMode)
+	}
+	if expOpts.kvMin > expOpts.kvMax {
+		return nil, fmt.Errorf("-kv.min %g is greater than -kv.max %g", expOpts.kvMin, expOpts.kvMax)
+	}
+
+	var serviceInclude, serviceExclude *regexp.Regexp
+	if expOpts.serviceInclude != "" {
+		if serviceInclude, err = regexp.Compile(expOpts.serviceInclude); err != nil {
+			return nil, fmt.Errorf("invalid service include pattern: %s", err)
+		}
+	}
+	if expOpts.serviceExclude != "" {
+		if serviceExclude, err = regexp.Compile(expOpts.serviceExclude); err != nil {
+			return nil, fmt.Errorf("invalid service exclude pattern: %s", err)
+		}
+	}
+
+	if expOpts.nodeLabel != "name" && expOpts.nodeLabel != "id" {
+		return nil, fmt.Errorf("invalid node label %q, expected name or id", expOpts.nodeLabel)
+	}
+
+	var checkStates map[string]bool
+	for _, state := range splitList(expOpts.checkStates) {
+		switch state {
+		case consul_api.HealthPassing, consul_api.HealthWarning, consul_api.HealthCritical:
+		default:
+			return nil, fmt.Errorf("invalid check state %q, expected passing, warning or critical", state)
+		}
+		if checkStates == nil {
+			checkStates = map[string]bool{}
+		}
+		checkStates[state] = true
+	}
+
+	nodeMetaKeys := splitList(expOpts.nodeMetaLabels)
+	nodeMetaLabelNames, err := metaLabelNames([]string{"node"}, nodeMetaKeys)
+	if err != nil {
+		return nil, err
+	}
+	serviceMetaKeys := splitList(expOpts.serviceMetaLabels)
+	serviceMetaLabelNames, err := metaLabelNames([]string{"service", "node"}, serviceMetaKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	constLabels := prometheus.Labels{"dc": datacenter}
+	if opts.namespace != "" {
+		constLabels["namespace"] = opts.namespace
+	}
+	if opts.partition != "" {
+		constLabels["partition"] = opts.partition
+	}
 
 	// Init our exporter.
-	return &Exporter{
-		URI: uri,
+	e := &Exporter{
+		URI: strings.Join(uris, ","),
 		up: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "up",
-			Help:      "Was the last query of Consul successful.",
+			Namespace:   namespace,
+			Name:        "up",
+			Help:        "Was the last query of Consul successful.",
+			ConstLabels: constLabels,
 		}),
 
 		clusterServers: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "raft_peers",
-			Help:      "How many peers (servers) are in the Raft cluster.",
+			Namespace:   namespace,
+			Name:        "raft_peers",
+			Help:        "How many peers (servers) are in the Raft cluster.",
+			ConstLabels: constLabels,
 		}),
 
-		nodeCount: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "serf_lan_members",
-			Help:      "How many members are in the cluster.",
-		}),
+		raftLeader: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "raft_leader",
+				Help:        "Is this Raft peer the leader? All peers are 0 while there is no leader.",
+				ConstLabels: constLabels,
+			},
+			[]string{"address"},
+		),
 
-		serviceCount: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "catalog_services",
-			Help:      "How many services are in the cluster.",
-		}),
+		autopilotHealthy: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "autopilot_healthy",
+				Help:        "Does Autopilot consider the cluster healthy? Not exported by Consul versions without Autopilot.",
+				ConstLabels: constLabels,
+			},
+			nil,
+		),
 
-		serviceNodesTotal: prometheus.NewGaugeVec(
+		autopilotServerHealthy: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "catalog_service_nodes",
-				Help:      "Number of nodes currently registered for this service.",
+				Namespace:   namespace,
+				Name:        "autopilot_server_healthy",
+				Help:        "Does Autopilot consider this server healthy?",
+				ConstLabels: constLabels,
 			},
-			[]string{"service"},
+			[]string{"id", "name"},
 		),
 
-		serviceNodesHealthy: prometheus.NewGaugeVec(
+		raftConfigurationPeers: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "catalog_service_node_healthy",
-				Help:      "Is this service healthy on this node?",
+				Namespace:   namespace,
+				Name:        "raft_configuration_peers",
+				Help:        "How many servers are in the Raft configuration, by whether they vote.",
+				ConstLabels: constLabels,
 			},
-			[]string{"service", "node"},
+			[]string{"voter"},
 		),
 
-		nodeChecks: prometheus.NewGaugeVec(
+		raftLastContact: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "agent_check",
-				Help:      "Is this check passing on this node?",
+				Namespace:   namespace,
+				Name:        "raft_last_contact_seconds",
+				Help:        "Time since this follower last heard from the Raft leader, as seen by Autopilot.",
+				ConstLabels: constLabels,
 			},
-			[]string{"check", "node"},
+			[]string{"id", "name"},
 		),
 
-		keyValues: prometheus.NewGaugeVec(
+		raftLastIndex: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "catalog_kv",
-				Help:      "The values for selected keys in Consul's key/value catalog. Keys with non-numeric values are omitted.",
+				Namespace:   namespace,
+				Name:        "raft_last_index",
+				Help:        "Last Raft log index known to this server, as seen by Autopilot.",
+				ConstLabels: constLabels,
 			},
-			[]string{"key"},
+			[]string{"id", "name"},
 		),
 
-		client:   consul_client,
-		kvPrefix: kvPrefix,
-		kvFilter: regexp.MustCompile(kvFilter),
-	}
-}
+		agentServer: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "agent_server",
+				Help:        "Is the agent the exporter talks to a server (1) or a client (0).",
+				ConstLabels: constLabels,
+			},
+			nil,
+		),
 
-// Describe describes all the metrics ever exported by the Consul exporter. It
-// implements prometheus.Collector.
-func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
-	ch <- e.up.Desc()
-	ch <- e.nodeCount.Desc()
-	ch <- e.serviceCount.Desc()
-	ch <- e.clusterServers.Desc()
+		agentSelfHealthy: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "agent_self_healthy",
+				Help:        "Are all the checks registered with the agent the exporter talks to passing? Only exported with -consul.expose-agent-health.",
+				ConstLabels: constLabels,
+			},
+			nil,
+		),
 
-	e.serviceNodesTotal.Describe(ch)
-	e.serviceNodesHealthy.Describe(ch)
-	e.keyValues.Describe(ch)
-}
+		licenseExpiry: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "license_expiry_seconds",
+				Help:        "Seconds until the Consul Enterprise license expires, negative once it has. Only exported with -consul.expose-license.",
+				ConstLabels: constLabels,
+			},
+			nil,
+		),
 
-// Collect fetches the stats from configured Consul location and delivers them
-// as Prometheus metrics. It implements prometheus.Collector.
-func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	services := make(chan []*consul_api.ServiceEntry)
-	checks := make(chan []*consul_api.HealthCheck)
+		datacenterCount: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "catalog_datacenters",
+				Help:        "How many datacenters the cluster knows of through WAN federation, its own included. Only exported with -consul.expose-datacenters.",
+				ConstLabels: constLabels,
+			},
+			nil,
+		),
 
-	go e.queryClient(services, checks)
+		datacenterReachable: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "datacenter_reachable",
+				Help:        "Did this datacenter name its Raft leader in time? Only exported with -consul.expose-datacenters.",
+				ConstLabels: constLabels,
+			},
+			[]string{"datacenter"},
+		),
 
-	e.mutex.Lock() // To protect metrics from concurrent collects.
-	defer e.mutex.Unlock()
+		versionInfo: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "version_info",
+				Help:        "Version of Consul run by the agent the exporter talks to. Always 1.",
+				ConstLabels: constLabels,
+			},
+			[]string{"version", "revision"},
+		),
 
-	// Reset metrics.
-	e.serviceNodesTotal.Reset()
-	e.serviceNodesHealthy.Reset()
-	e.nodeChecks.Reset()
+		sessions: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "catalog_sessions",
+				Help:        "How many sessions are active on each node?",
+				ConstLabels: constLabels,
+			},
+			[]string{"node"},
+		),
 
-	e.setMetrics(services, checks)
+		preparedQueries: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "prepared_queries",
+				Help:        "How many prepared queries are defined?",
+				ConstLabels: constLabels,
+			},
+			nil,
+		),
 
-	ch <- e.up
-	ch <- e.clusterServers
-	ch <- e.nodeCount
-	ch <- e.serviceCount
+		preparedQueryInfo: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "prepared_query_info",
+				Help:        "Information about a prepared query. Always 1.",
+				ConstLabels: constLabels,
+			},
+			[]string{"id", "name", "service"},
+		),
 
-	e.serviceNodesTotal.Collect(ch)
-	e.serviceNodesHealthy.Collect(ch)
-	e.nodeChecks.Collect(ch)
+		intentions: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "connect_intentions",
+				Help:        "How many Connect intentions are defined, by action?",
+				ConstLabels: constLabels,
+			},
+			[]string{"action"},
+		),
+
+		connectTopology: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "connect_topology",
+				Help:        "A Connect intention from this source to this destination service, by action. Always 1.",
+				ConstLabels: constLabels,
+			},
+			[]string{"source", "destination", "action"},
+		),
+
+		networkRTT: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "network_rtt_seconds",
+				Help:        "Round trip time from the queried agent to the node, estimated from network coordinates.",
+				ConstLabels: constLabels,
+			},
+			[]string{"node"},
+		),
+
+		nodeMetadata: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "node_metadata",
+				Help:        "Metadata of this node, as selected by -consul.node-meta-labels. Always 1.",
+				ConstLabels: constLabels,
+			},
+			nodeMetaLabelNames,
+		),
+
+		nodeCount: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "serf_lan_members",
+				Help:        "How many members are in the cluster. A gauge; earlier releases typed it as a counter.",
+				ConstLabels: constLabels,
+			},
+			nil,
+		),
+
+		memberStatus: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "serf_lan_member_status",
+				Help:        "Status of this member in the LAN pool: 1=Alive, 2=Leaving, 3=Left, 4=Failed.",
+				ConstLabels: constLabels,
+			},
+			memberLabelNames,
+		),
+
+		wanMemberCount: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "serf_wan_members",
+				Help:        "How many members are in the WAN pool, as seen by the agent. Always 0 on client agents.",
+				ConstLabels: constLabels,
+			},
+			nil,
+		),
+
+		serviceCount: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "catalog_services",
+				Help:        "How many services are in the cluster. A gauge; earlier releases typed it as a counter.",
+				ConstLabels: constLabels,
+			},
+			nil,
+		),
+
+		catalogLastIndex: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "catalog_last_index",
+				Help:        "Raft index at which the list of services last changed, as returned by Consul in X-Consul-Index.",
+				ConstLabels: constLabels,
+			},
+			nil,
+		),
+
+		queryLastContact: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "query_last_contact_seconds",
+				Help:        "How long ago the server that answered the catalog query last heard from the leader. Only above 0 with -consul.allow-stale.",
+				ConstLabels: constLabels,
+			},
+			nil,
+		),
+
+		queryKnownLeader: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "query_known_leader",
+				Help:        "Did the server that answered the catalog query know of a leader?",
+				ConstLabels: constLabels,
+			},
+			nil,
+		),
+
+		serviceExists: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "catalog_service_exists",
+				Help:        "Is this service in the catalog? Reported even when it has no instances left.",
+				ConstLabels: constLabels,
+			},
+			[]string{"service"},
+		),
+
+		serviceNodesTotal: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "catalog_service_nodes",
+				Help:        "Number of nodes currently registered for this service.",
+				ConstLabels: constLabels,
+			},
+			[]string{"service"},
+		),
+
+		serviceNodesHealthy: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "catalog_service_node_healthy",
+				Help:        "Is this service healthy on this node? With several instances on the node, all of them must be.",
+				ConstLabels: constLabels,
+			},
+			[]string{"service", "node"},
+		),
+
+		serviceNodesStatus: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "catalog_service_node_status",
+				Help:        "Status of this service on this node: 1 for the current status (passing, warning, critical or maintenance), 0 otherwise.",
+				ConstLabels: constLabels,
+			},
+			[]string{"service", "node", "status"},
+		),
+
+		serviceTags: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "service_tag",
+				Help:        "Tags of this service on this node, one series per tag. Only exported with -consul.expose-tags, as it adds a series for every tag of every service instance.",
+				ConstLabels: constLabels,
+			},
+			[]string{"service", "node", "tag"},
+		),
+
+		unhealthyInstances: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "catalog_unhealthy_service_instances",
+				Help:        "How many service instances across all services have at least one check that isn't passing.",
+				ConstLabels: constLabels,
+			},
+			nil,
+		),
+
+		meshGateways: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "mesh_gateways",
+				Help:        "How many instances of each kind of gateway are registered.",
+				ConstLabels: constLabels,
+			},
+			[]string{"kind"},
+		),
+
+		nodeServices: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "node_services",
+				Help:        "How many distinct services have instances on this node.",
+				ConstLabels: constLabels,
+			},
+			[]string{"node"},
+		),
+
+		serviceTagNodes: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "catalog_service_tag_nodes",
+				Help:        "Number of instances of this service that carry this tag. Only exported with -consul.expose-tags.",
+				ConstLabels: constLabels,
+			},
+			[]string{"service", "tag"},
+		),
+
+		servicePort: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "service_port",
+				Help:        "Port this service is registered with on this node.",
+				ConstLabels: constLabels,
+			},
+			[]string{"service", "node"},
+		),
+
+		serviceAddress: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "service_address_info",
+				Help:        "Address this service is reachable at on this node, falling back to the node's address when the service doesn't set one. Always 1.",
+				ConstLabels: constLabels,
+			},
+			[]string{"service", "node", "address"},
+		),
+
+		serviceWeight: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "service_weight",
+				Help:        "Weight of this service instance in DNS SRV responses while its health is in this state.",
+				ConstLabels: constLabels,
+			},
+			[]string{"service", "node", "state"},
+		),
+
+		serviceMetadata: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "service_metadata",
+				Help:        "Metadata of this service on this node, as selected by -consul.service-meta-labels. Always 1.",
+				ConstLabels: constLabels,
+			},
+			serviceMetaLabelNames,
+		),
+
+		nodeChecks: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "agent_check",
+				Help:        "Is this check passing on this node?",
+				ConstLabels: constLabels,
+			},
+			[]string{"check", "node"},
+		),
+
+		serviceChecks: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "service_check",
+				Help:        "Is this service check passing on this node?",
+				ConstLabels: constLabels,
+			},
+			[]string{"check", "node", "service"},
+		),
+
+		checkLastUpdate: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "check_last_update",
+				Help:        "Unix time at which the exporter first saw the current status and output of this check. Only exported with -consul.expose-check-output.",
+				ConstLabels: constLabels,
+			},
+			[]string{"check", "node"},
+		),
+
+		deregisterCritical: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "service_deregister_critical_seconds",
+				Help:        "Seconds left before Consul deregisters this service for being critical, counted from when the exporter first saw the check critical.",
+				ConstLabels: constLabels,
+			},
+			[]string{"check", "node", "service"},
+		),
+
+		checksByType: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "checks_by_type",
+				Help:        "Number of checks of this type, such as script, http, tcp or ttl.",
+				ConstLabels: constLabels,
+			},
+			[]string{"type"},
+		),
+
+		healthChecks: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "health_checks",
+				Help:        "Number of checks, node and service checks alike, in this status (passing, warning, critical or maintenance).",
+				ConstLabels: constLabels,
+			},
+			[]string{"status"},
+		),
+
+		nodeMaintenance: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "node_maintenance",
+				Help:        "Is this node in maintenance mode? Only nodes that are have a series, set to 1.",
+				ConstLabels: constLabels,
+			},
+			[]string{"node"},
+		),
+
+		serviceMaintenance: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "service_maintenance",
+				Help:        "Is this service in maintenance mode on this node? Only services that are have a series, set to 1.",
+				ConstLabels: constLabels,
+			},
+			[]string{"service", "node"},
+		),
+
+		nodeChecksFailing: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "node_checks_failing",
+				Help:        "Number of checks on this node, node and service checks alike, that are not passing. Maintenance mode is not counted.",
+				ConstLabels: constLabels,
+			},
+			[]string{"node"},
+		),
+
+		keyValues: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "catalog_kv",
+				Help:        "The values for selected keys in Consul's key/value catalog. Keys with non-numeric values are omitted.",
+				ConstLabels: constLabels,
+			},
+			[]string{"key"},
+		),
+
+		kvUnparsable: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "kv_unparsable",
+				Help:        "Selected keys whose value is neither a number nor listed in -kv.value-map, and so isn't exported. Always 1.",
+				ConstLabels: constLabels,
+			},
+			[]string{"key"},
+		),
+
+		kvKeys: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "catalog_kv_keys",
+				Help:        "Number of keys under this -kv.prefix, whether or not they are exported.",
+				ConstLabels: constLabels,
+			},
+			[]string{"prefix"},
+		),
+
+		kvListSuccess: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "catalog_kv_list_success",
+				Help:        "Could the keys under this -kv.prefix be listed? A prefix that doesn't exist lists fine, with no keys.",
+				ConstLabels: constLabels,
+			},
+			[]string{"prefix"},
+		),
+
+		kvFlags: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "catalog_kv_flags",
+				Help:        "Flags that applications stored along with the value of this key.",
+				ConstLabels: constLabels,
+			},
+			[]string{"key"},
+		),
+
+		kvInfo: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "kv_info",
+				Help:        "The raw values for selected keys in Consul's key/value catalog, with -kv.mode=info. Always 1.",
+				ConstLabels: constLabels,
+			},
+			[]string{"key", "value"},
+		),
+
+		activeServer: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "exporter_active_server",
+				Help:        "The Consul server that answered the last scrape. Always 1.",
+				ConstLabels: constLabels,
+			},
+			[]string{"server"},
+		),
+
+		rateLimitedTotal: prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "exporter",
+			Name:        "rate_limited_total",
+			Help:        "How many requests to Consul had to wait for their turn under -consul.rate-limit.",
+			ConstLabels: constLabels,
+		}, func() float64 {
+			return float64(servers[0].limiter.waits.Load())
+		}),
+
+		scrapeDuration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   "exporter",
+			Name:        "scrape_duration_seconds",
+			Help:        "How long the last scrape of Consul took.",
+			ConstLabels: constLabels,
+		}),
+
+		lastScrapeError: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   "exporter",
+			Name:        "last_scrape_error",
+			Help:        "Did any query of the last scrape of Consul fail or time out, leaving out those our token isn't allowed to make.",
+			ConstLabels: constLabels,
+		}),
+
+		queryDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace:   namespace,
+				Subsystem:   "exporter",
+				Name:        "query_duration_seconds",
+				Help:        "How long queries of this kind against Consul took, each attempt and each service or KV prefix on its own.",
+				Buckets:     prometheus.ExponentialBuckets(0.001, 2, 15),
+				ConstLabels: constLabels,
+			},
+			[]string{"query"},
+		),
+
+		watchErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   namespace,
+				Subsystem:   "exporter",
+				Name:        "watch_errors_total",
+				Help:        "How many blocking queries of this kind failed under -consul.watch.",
+				ConstLabels: constLabels,
+			},
+			[]string{"query"},
+		),
+
+		watchConnected: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Subsystem:   "exporter",
+				Name:        "watch_connected",
+				Help:        "Did the last blocking query of this kind under -consul.watch succeed?",
+				ConstLabels: constLabels,
+			},
+			[]string{"query"},
+		),
+
+		retriesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   namespace,
+				Subsystem:   "exporter",
+				Name:        "query_retries_total",
+				Help:        "How many times queries of this kind against Consul have been retried.",
+				ConstLabels: constLabels,
+			},
+			[]string{"query"},
+		),
+
+		scrapeErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   namespace,
+				Subsystem:   "exporter",
+				Name:        "scrape_errors_total",
+				Help:        "How many queries of this kind against Consul have failed.",
+				ConstLabels: constLabels,
+			},
+			[]string{"query"},
+		),
+
+		cacheHit: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   "exporter",
+			Name:        "cache_hit",
+			Help:        "Was this scrape served from the results of an earlier one, within -consul.cache-ttl.",
+			ConstLabels: constLabels,
+		}),
+
+		refreshAge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   "exporter",
+			Name:        "refresh_age_seconds",
+			Help:        "How long ago the metrics were last refreshed from Consul, or the exporter started if they never were.",
+			ConstLabels: constLabels,
+		}),
+
+		querySuccess: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Subsystem:   "exporter",
+				Name:        "query_success",
+				Help:        "Was the last query of this kind against Consul successful.",
+				ConstLabels: constLabels,
+			},
+			[]string{"query"},
+		),
+
+		client:      servers[0].client,
+		agentClient: servers[0].agentClient,
+		servers:     servers,
+		kvPrefixes:  kvPrefixes,
+		kvValueMap:  kvValueMap,
+		kvParseMode: expOpts.kvParseMode,
+		kvInfoMode:  expOpts.kvMode == "info",
+		kvMin:       expOpts.kvMin,
+		kvMax:       expOpts.kvMax,
+		exposeTags:  expOpts.exposeTags,
+
+		exposeCheckOutput:        expOpts.exposeCheckOutput,
+		healthFromState:          expOpts.healthFromState,
+		exposeIntentions:         expOpts.exposeIntentions,
+		exposeCoordinates:        expOpts.exposeCoordinates,
+		exposeRaftLag:            expOpts.exposeRaftLag,
+		exposeAgentHealth:        expOpts.exposeAgentHealth,
+		exposeLicense:            expOpts.exposeLicense,
+		exposeConnectTopology:    expOpts.exposeConnectTopology,
+		exposeDatacenters:        expOpts.exposeDatacenters,
+		exposeDeregisterCritical: expOpts.exposeDeregisterCritical,
+		warningAsHealthy:         expOpts.warningAsHealthy,
+		checkUpdates:             map[checkKey]checkUpdate{},
+		criticalSince:            map[checkKey]time.Time{},
+		nodeLabelID:              expOpts.nodeLabel == "id",
+		collectKV:                expOpts.collectKV,
+		collectServiceEntries:    expOpts.collectServiceEntries,
+		collectServiceInstances:  expOpts.collectServiceInstances,
+		collectChecks:            expOpts.collectChecks,
+
+		serviceInclude:      serviceInclude,
+		serviceExclude:      serviceExclude,
+		nodes:               splitList(expOpts.nodes),
+		checkStates:         checkStates,
+		nodeMetaKeys:        nodeMetaKeys,
+		serviceMetaKeys:     serviceMetaKeys,
+		agentMetricPrefixes: splitList(expOpts.agentMetricPrefixes),
+		metricsNamespace:    namespace,
+		constLabels:         constLabels,
+		datacenter:          datacenter,
+		remote:              remote,
+		managementToken:     opts.managementToken,
+		queryOptions: consul_api.QueryOptions{
+			Datacenter:        opts.datacenter,
+			Namespace:         opts.namespace,
+			Partition:         opts.partition,
+			AllowStale:        opts.allowStale,
+			RequireConsistent: opts.requireConsistent,
+		},
+		timeout:            opts.timeout,
+		cacheTTL:           opts.cacheTTL,
+		background:         opts.watch || opts.scrapeInterval > 0,
+		lastRefresh:        time.Now(),
+		logger:             logger,
+		concurrentRequests: opts.concurrentRequests,
+		retries:            opts.retries,
+		retryInterval:      opts.retryInterval,
+	}
+	// Until the first refresh, Collect delivers the metrics as they start out.
+	e.results = e.freezeResults()
+	return e, nil
+}
+
+// Describe describes all the metrics ever exported by the Consul exporter. It
+// implements prometheus.Collector.
+func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- e.up.Desc()
+	e.nodeCount.Describe(ch)
+	e.nodeMetadata.Describe(ch)
+	e.memberStatus.Describe(ch)
+	e.wanMemberCount.Describe(ch)
+	e.serviceCount.Describe(ch)
+	e.serviceExists.Describe(ch)
+	e.catalogLastIndex.Describe(ch)
+	e.queryLastContact.Describe(ch)
+	e.queryKnownLeader.Describe(ch)
+	ch <- e.clusterServers.Desc()
+	e.raftLeader.Describe(ch)
+	e.autopilotHealthy.Describe(ch)
+	e.autopilotServerHealthy.Describe(ch)
+	e.raftConfigurationPeers.Describe(ch)
+	e.raftLastContact.Describe(ch)
+	e.raftLastIndex.Describe(ch)
+	e.agentServer.Describe(ch)
+	e.agentSelfHealthy.Describe(ch)
+	e.licenseExpiry.Describe(ch)
+	e.datacenterCount.Describe(ch)
+	e.datacenterReachable.Describe(ch)
+	e.versionInfo.Describe(ch)
+	e.sessions.Describe(ch)
+	e.preparedQueries.Describe(ch)
+	e.preparedQueryInfo.Describe(ch)
+	e.intentions.Describe(ch)
+	e.connectTopology.Describe(ch)
+	e.networkRTT.Describe(ch)
+
+	e.serviceNodesTotal.Describe(ch)
+	e.serviceNodesHealthy.Describe(ch)
+	e.serviceNodesStatus.Describe(ch)
+	e.serviceTags.Describe(ch)
+	e.serviceTagNodes.Describe(ch)
+	e.nodeServices.Describe(ch)
+	e.unhealthyInstances.Describe(ch)
+	e.meshGateways.Describe(ch)
+	e.checksByType.Describe(ch)
+	e.healthChecks.Describe(ch)
+	e.nodeMaintenance.Describe(ch)
+	e.serviceMaintenance.Describe(ch)
+	e.servicePort.Describe(ch)
+	e.serviceAddress.Describe(ch)
+	e.serviceWeight.Describe(ch)
+	e.serviceMetadata.Describe(ch)
+	e.nodeChecks.Describe(ch)
+	e.serviceChecks.Describe(ch)
+	e.checkLastUpdate.Describe(ch)
+	e.nodeChecksFailing.Describe(ch)
+	e.deregisterCritical.Describe(ch)
+	e.keyValues.Describe(ch)
+	e.kvInfo.Describe(ch)
+	e.kvUnparsable.Describe(ch)
+	e.kvKeys.Describe(ch)
+	e.kvListSuccess.Describe(ch)
+	e.kvFlags.Describe(ch)
+	e.querySuccess.Describe(ch)
+	e.scrapeErrors.Describe(ch)
+	e.retriesTotal.Describe(ch)
+	e.watchErrors.Describe(ch)
+	e.watchConnected.Describe(ch)
+	e.queryDuration.Describe(ch)
+	ch <- e.scrapeDuration.Desc()
+	ch <- e.rateLimitedTotal.Desc()
+	ch <- e.lastScrapeError.Desc()
+	ch <- e.cacheHit.Desc()
+	ch <- e.refreshAge.Desc()
+	e.activeServer.Describe(ch)
+}
+
+// Collect fetches the stats from configured Consul location and delivers them
+// as Prometheus metrics. It implements prometheus.Collector.
+func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	// Unless Watch or ScrapeEvery query Consul in the background, the scrape
+	// does. Scrapes that follow each other closely, such as those of a pair
+	// of Prometheus servers, share the results of a single set of queries.
+	if !e.background {
+		e.scrapeMutex.Lock()
+		defer e.scrapeMutex.Unlock()
+
+		if e.cacheTTL > 0 && time.Since(e.lastScrape) < e.cacheTTL {
+			e.cacheHit.Set(1)
+		} else {
+			e.cacheHit.Set(0)
+			e.refresh()
+		}
+	}
+
+	e.mutex.RLock()
+	metrics, lastRefresh := e.results.metrics, e.lastRefresh
+	e.mutex.RUnlock()
+
+	for _, m := range metrics {
+		ch <- m
+	}
+
+	// The counters keep counting between refreshes, so they are delivered
+	// as they stand.
+	e.scrapeErrors.Collect(ch)
+	e.retriesTotal.Collect(ch)
+	e.watchErrors.Collect(ch)
+	e.watchConnected.Collect(ch)
+	e.queryDuration.Collect(ch)
+	ch <- e.rateLimitedTotal
+	ch <- e.cacheHit
+	e.refreshAge.Set(time.Since(lastRefresh).Seconds())
+	ch <- e.refreshAge
+}
+
+// results holds the metrics of a refresh, as Collect delivers them.
+type results struct {
+	metrics      []prometheus.Metric
+	agentMetrics []prometheus.Metric
+}
+
+// refresh scrapes Consul and swaps the results in for Collect to deliver.
+// Only the swap holds mutex, so scrapes are answered with the previous
+// results while Consul is queried.
+func (e *Exporter) refresh() {
+	e.scrape()
+	results := e.freezeResults()
+
+	e.mutex.Lock()
+	e.results = results
+	e.lastRefresh = time.Now()
+	e.mutex.Unlock()
+}
+
+// freezeResults copies the results of the last scrape, so that the next one
+// can't change them while they are delivered.
+func (e *Exporter) freezeResults() results {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		e.collectMetrics(ch)
+		close(ch)
+	}()
+
+	var metrics []prometheus.Metric
+	for m := range ch {
+		frozen := frozenMetric{desc: m.Desc(), metric: &dto.Metric{}}
+		if err := m.Write(frozen.metric); err != nil {
+			level.Debug(e.logger).Log("msg", "Skipping metric", "desc", m.Desc(), "err", err)
+			continue
+		}
+		metrics = append(metrics, frozen)
+	}
+	// Agent metrics are const metrics already.
+	return results{metrics: metrics, agentMetrics: e.agentMetrics}
+}
+
+// frozenMetric is a metric as it was written at some point.
+type frozenMetric struct {
+	desc   *prometheus.Desc
+	metric *dto.Metric
+}
+
+// Desc implements prometheus.Metric.
+func (m frozenMetric) Desc() *prometheus.Desc {
+	return m.desc
+}
+
+// Write implements prometheus.Metric.
+func (m frozenMetric) Write(out *dto.Metric) error {
+	out.Label = m.metric.Label
+	out.Gauge = m.metric.Gauge
+	out.Counter = m.metric.Counter
+	out.Summary = m.metric.Summary
+	out.Untyped = m.metric.Untyped
+	out.Histogram = m.metric.Histogram
+	out.TimestampMs = m.metric.TimestampMs
+	return nil
+}
+
+// scrape queries Consul and updates every metric with the results.
+func (e *Exporter) scrape() {
+	// Bound the whole scrape so a slow Consul can't hang it, unless
+	// -consul.timeout is 0.
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	if e.timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), e.timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+
+	// Reset metrics.
+	e.complete = false
+	e.nodeCount.Reset()
+	e.wanMemberCount.Reset()
+	e.serviceCount.Reset()
+	e.serviceExists.Reset()
+	e.catalogLastIndex.Reset()
+	e.queryLastContact.Reset()
+	e.queryKnownLeader.Reset()
+	e.raftLeader.Reset()
+	e.autopilotHealthy.Reset()
+	e.autopilotServerHealthy.Reset()
+	e.raftConfigurationPeers.Reset()
+	e.raftLastContact.Reset()
+	e.raftLastIndex.Reset()
+	e.agentServer.Reset()
+	e.agentSelfHealthy.Reset()
+	e.licenseExpiry.Reset()
+	e.datacenterCount.Reset()
+	e.datacenterReachable.Reset()
+	e.versionInfo.Reset()
+	e.sessions.Reset()
+	e.preparedQueries.Reset()
+	e.preparedQueryInfo.Reset()
+	e.intentions.Reset()
+	e.connectTopology.Reset()
+	e.networkRTT.Reset()
+	e.memberStatus.Reset()
+	e.nodeMetadata.Reset()
+	e.serviceNodesTotal.Reset()
+	e.serviceNodesHealthy.Reset()
+	e.serviceNodesStatus.Reset()
+	e.serviceTags.Reset()
+	e.serviceTagNodes.Reset()
+	e.nodeServices.Reset()
+	e.unhealthyInstances.Reset()
+	e.meshGateways.Reset()
+	e.checksByType.Reset()
+	e.healthChecks.Reset()
+	e.nodeMaintenance.Reset()
+	e.serviceMaintenance.Reset()
+	e.servicePort.Reset()
+	e.serviceAddress.Reset()
+	e.serviceWeight.Reset()
+	e.serviceMetadata.Reset()
+	e.nodeChecks.Reset()
+	e.serviceChecks.Reset()
+	e.checkLastUpdate.Reset()
+	e.nodeChecksFailing.Reset()
+	e.deregisterCritical.Reset()
+	e.keyValues.Reset()
+	e.kvInfo.Reset()
+	e.kvUnparsable.Reset()
+	e.kvKeys.Reset()
+	e.kvListSuccess.Reset()
+	e.kvFlags.Reset()
+	e.querySuccess.Reset()
+	e.activeServer.Reset()
+	e.agentMetrics = nil
+
+	services := make(chan []*consul_api.ServiceEntry)
+	checks := make(chan []*consul_api.HealthCheck)
+
+	start := time.Now()
+	go e.queryClient(ctx, services, checks)
+
+	e.setMetrics(services, checks)
+	if e.complete {
+		e.setKeyValues(ctx)
+
+		// Which datacenters are federated, and can they be reached? Every
+		// datacenter knows the same ones, so only the agent's own asks.
+		// They come last so that one which doesn't answer only takes time
+		// left over by the rest of the scrape.
+		if e.exposeDatacenters && !e.remote && e.service == "" {
+			e.setDatacenters(ctx)
+		}
+	}
+
+	// Running out of time means we only got part of the picture.
+	if ctx.Err() == context.DeadlineExceeded {
+		e.up.Set(0)
+		e.complete = false
+		level.Error(e.logger).Log("msg", "Timed out querying Consul", "timeout", e.timeout)
+	}
+
+	e.scrapeDuration.Set(time.Since(start).Seconds())
+	failed := 0
+	if e.queryFailed.Swap(false) || ctx.Err() != nil {
+		failed = 1
+	}
+	e.lastScrapeError.Set(float64(failed))
+
+	// Only complete results are worth caching.
+	if failed == 0 {
+		e.lastScrape = start
+	} else {
+		e.lastScrape = time.Time{}
+	}
+}
+
+// collectMetrics delivers the results of the last scrape.
+func (e *Exporter) collectMetrics(ch chan<- prometheus.Metric) {
+	ch <- e.up
+
+	// A scrape that didn't get through to the end only has part of the
+	// picture, which is left out rather than mixed with older values.
+	if e.complete {
+		e.collectConsulMetrics(ch)
+	}
+
+	e.querySuccess.Collect(ch)
+	ch <- e.scrapeDuration
+	ch <- e.lastScrapeError
+	e.activeServer.Collect(ch)
+}
+
+// collectConsulMetrics delivers the metrics that describe Consul itself.
+func (e *Exporter) collectConsulMetrics(ch chan<- prometheus.Metric) {
+	ch <- e.clusterServers
+	e.nodeCount.Collect(ch)
+	e.nodeMetadata.Collect(ch)
+	e.memberStatus.Collect(ch)
+	e.wanMemberCount.Collect(ch)
+	e.serviceCount.Collect(ch)
+	e.serviceExists.Collect(ch)
+	e.catalogLastIndex.Collect(ch)
+	e.queryLastContact.Collect(ch)
+	e.queryKnownLeader.Collect(ch)
+	e.raftLeader.Collect(ch)
+	e.autopilotHealthy.Collect(ch)
+	e.autopilotServerHealthy.Collect(ch)
+	e.raftConfigurationPeers.Collect(ch)
+	e.raftLastContact.Collect(ch)
+	e.raftLastIndex.Collect(ch)
+	e.agentServer.Collect(ch)
+	e.agentSelfHealthy.Collect(ch)
+	e.licenseExpiry.Collect(ch)
+	e.datacenterCount.Collect(ch)
+	e.datacenterReachable.Collect(ch)
+	e.versionInfo.Collect(ch)
+	e.sessions.Collect(ch)
+	e.preparedQueries.Collect(ch)
+	e.preparedQueryInfo.Collect(ch)
+	e.intentions.Collect(ch)
+	e.connectTopology.Collect(ch)
+	e.networkRTT.Collect(ch)
+
+	e.serviceNodesTotal.Collect(ch)
+	e.serviceNodesHealthy.Collect(ch)
+	e.serviceNodesStatus.Collect(ch)
+	e.serviceTags.Collect(ch)
+	e.serviceTagNodes.Collect(ch)
+	e.nodeServices.Collect(ch)
+	e.unhealthyInstances.Collect(ch)
+	e.meshGateways.Collect(ch)
+	e.checksByType.Collect(ch)
+	e.healthChecks.Collect(ch)
+	e.nodeMaintenance.Collect(ch)
+	e.serviceMaintenance.Collect(ch)
+	e.servicePort.Collect(ch)
+	e.serviceAddress.Collect(ch)
+	e.serviceWeight.Collect(ch)
+	e.serviceMetadata.Collect(ch)
+	e.nodeChecks.Collect(ch)
+	e.serviceChecks.Collect(ch)
+	e.checkLastUpdate.Collect(ch)
+	e.nodeChecksFailing.Collect(ch)
+	e.deregisterCritical.Collect(ch)
+
+	e.keyValues.Collect(ch)
+	e.kvInfo.Collect(ch)
+	e.kvUnparsable.Collect(ch)
+	e.kvKeys.Collect(ch)
+	e.kvListSuccess.Collect(ch)
+	e.kvFlags.Collect(ch)
+}
+
+// ScrapeEvery queries Consul every interval in the background until ctx is
+// done, so that Collect only has to deliver the results.
+func (e *Exporter) ScrapeEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		e.refresh()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Watch keeps the metrics up to date in the background until ctx is done, so
+// that Collect only has to deliver them. Consul's blocking queries on the
+// catalog services and on the health checks tell when a refresh is due.
+func (e *Exporter) Watch(ctx context.Context) {
+	changed := make(chan struct{}, 1)
+
+	var watchers sync.WaitGroup
+	defer watchers.Wait()
+	watchers.Add(2)
+	go func() {
+		defer watchers.Done()
+		e.watchIndex(ctx, "services", changed, func(client *consul_api.Client, q *consul_api.QueryOptions) (*consul_api.QueryMeta, error) {
+			_, meta, err := client.Catalog().Services(q)
+			return meta, err
+		})
+	}()
+	go func() {
+		defer watchers.Done()
+		e.watchIndex(ctx, "checks", changed, func(client *consul_api.Client, q *consul_api.QueryOptions) (*consul_api.QueryMeta, error) {
+			_, meta, err := client.Health().State("any", q)
+			return meta, err
+		})
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		}
+
+		e.refresh()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(watchMinInterval):
+		}
+	}
+}
+
+// watchIndex runs the blocking query fetch until ctx is done, and signals
+// changed whenever it returns, be it with a new index, after watchWaitTime or
+// with an error. The scrape that follows an error reports Consul as down and
+// fails over to the next -consul.server, which the next fetch then uses.
+func (e *Exporter) watchIndex(ctx context.Context, query string, changed chan<- struct{}, fetch func(*consul_api.Client, *consul_api.QueryOptions) (*consul_api.QueryMeta, error)) {
+	var index uint64
+	backoff := watchMinBackoff
+	e.watchErrors.WithLabelValues(query).Add(0)
+	for ctx.Err() == nil {
+		// Scrapes may fail over to another server.
+		e.mutex.RLock()
+		client := e.client
+		e.mutex.RUnlock()
+
+		opts := e.queryOptions
+		opts.WaitIndex = index
+		opts.WaitTime = watchWaitTime
+		meta, err := fetch(client, opts.WithContext(ctx))
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			e.watchErrors.WithLabelValues(query).Inc()
+			e.watchConnected.WithLabelValues(query).Set(0)
+			level.Error(e.logger).Log("msg", "Failed to watch Consul", "query", query, "retry_in", backoff, "err", err)
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > watchMaxBackoff {
+				backoff = watchMaxBackoff
+			}
+			continue
+		}
+		backoff = watchMinBackoff
+		e.watchConnected.WithLabelValues(query).Set(1)
+
+		// An index that goes backwards, e.g. after a snapshot restore, means
+		// starting over. Waiting on 0 doesn't block at all, so start over
+		// from 1, as Consul recommends.
+		if meta.LastIndex < index || meta.LastIndex == 0 {
+			index = 1
+		} else {
+			index = meta.LastIndex
+		}
+
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// newQueryOptions returns a fresh copy of the options shared by every query
+// against Consul, bound to ctx.
+func (e *Exporter) newQueryOptions(ctx context.Context) *consul_api.QueryOptions {
+	opts := e.queryOptions
+	return opts.WithContext(ctx)
+}
+
+// setAgentInfo exports what the agent itself knows: the members of its gossip
+// pools, its own configuration and telemetry.
+func (e *Exporter) setAgentInfo(ctx context.Context) {
+	// What state are the LAN members in?
+	lanMembers, err := e.agentClient.Agent().Members(false)
+	e.recordQuery("lan_members", err)
+
+	if err != nil {
+		level.Error(e.logger).Log("msg", "Failed to query LAN members", "err", err)
+	} else {
+		for _, member := range lanMembers {
+			e.memberStatus.WithLabelValues(member.Name).Set(float64(member.Status))
+		}
+	}
+
+	// How big is the WAN pool? Only servers are part of it.
+	wanMembers, err := e.agentClient.Agent().Members(true)
+	e.recordQuery("wan_members", err)
+
+	if err != nil {
+		level.Error(e.logger).Log("msg", "Failed to query WAN members", "err", err)
+	} else {
+		e.wanMemberCount.WithLabelValues().Set(float64(len(wanMembers)))
+	}
+
+	// Is the agent we talk to a server, and which version does it run?
+	self, err := e.agentClient.Agent().Self()
+	e.recordQuery("agent_self", err)
+
+	if err != nil {
+		level.Error(e.logger).Log("msg", "Failed to query the agent's configuration", "err", err)
+	} else {
+		isServer, _ := self["Config"]["Server"].(bool)
+		e.agentServer.WithLabelValues().Set(boolToFloat(isServer))
+		version, _ := self["Config"]["Version"].(string)
+		revision, _ := self["Config"]["Revision"].(string)
+		e.versionInfo.WithLabelValues(version, revision).Set(1)
+	}
+
+	// Is the agent healthy by its own checks? serfHealth is kept by the
+	// servers rather than the agent, so it comes from the catalog instead,
+	// which needs the agent's node name.
+	if e.exposeAgentHealth && self != nil {
+		checks, err := e.client.Agent().ChecksWithFilterOpts("", e.newQueryOptions(ctx))
+		e.recordQuery("agent_checks", err)
+
+		var nodeChecks consul_api.HealthChecks
+		if err == nil {
+			nodeName, _ := self["Config"]["NodeName"].(string)
+			nodeChecks, _, err = e.client.Health().Node(nodeName, e.newQueryOptions(ctx))
+			e.recordQuery("agent_node_checks", err)
+		}
+
+		if err != nil {
+			level.Error(e.logger).Log("msg", "Failed to query the agent's checks", "err", err)
+		} else {
+			healthy := true
+			for _, hc := range checks {
+				healthy = healthy && e.isPassing(hc.Status)
+			}
+			for _, hc := range nodeChecks {
+				if hc.CheckID == "serfHealth" {
+					healthy = healthy && e.isPassing(hc.Status)
+				}
+			}
+			e.agentSelfHealthy.WithLabelValues().Set(boolToFloat(healthy))
+		}
+	}
+
+	// What does the agent report about itself?
+	if len(e.agentMetricPrefixes) > 0 {
+		e.setAgentMetrics()
+	}
+}
+
+// newManagementQueryOptions is newQueryOptions for the endpoints that need
+// more than read access, which use -consul.management-token when it is set.
+func (e *Exporter) newManagementQueryOptions(ctx context.Context) *consul_api.QueryOptions {
+	opts := e.newQueryOptions(ctx)
+	if e.managementToken != "" {
+		opts.Token = e.managementToken
+	}
+	return opts
+}
+
+// setAutopilotHealth exports the health of the servers as seen by Autopilot.
+// Consul versions that predate Autopilot are skipped silently.
+func (e *Exporter) setAutopilotHealth(ctx context.Context) {
+	health, err := e.client.Operator().AutopilotServerHealth(e.newManagementQueryOptions(ctx))
+	if hasStatusCode(err, http.StatusNotFound) {
+		level.Debug(e.logger).Log("msg", "Autopilot is not supported by this Consul version")
+		return
+	}
+	e.recordQuery("autopilot", err)
+
+	if err != nil {
+		level.Error(e.logger).Log("msg", "Failed to query Autopilot health", "err", err)
+		return
+	}
+
+	e.autopilotHealthy.WithLabelValues().Set(boolToFloat(health.Healthy))
+	for _, server := range health.Servers {
+		e.autopilotServerHealthy.WithLabelValues(server.ID, server.Name).Set(boolToFloat(server.Healthy))
+
+		// Autopilot asks the leader, whichever server we talk to, and doesn't
+		// track the leader's contact with itself.
+		if e.exposeRaftLag {
+			e.raftLastIndex.WithLabelValues(server.ID, server.Name).Set(float64(server.LastIndex))
+			if !server.Leader {
+				e.raftLastContact.WithLabelValues(server.ID, server.Name).Set(server.LastContact.Duration().Seconds())
+			}
+		}
+	}
+}
+
+// setPreparedQueries exports the prepared queries visible to our token.
+// Listing them may need more privileges than the rest of the exporter, so
+// being refused is only logged at debug level.
+func (e *Exporter) setPreparedQueries(ctx context.Context) {
+	queries, _, err := e.client.PreparedQuery().List(e.newManagementQueryOptions(ctx))
+	if hasStatusCode(err, http.StatusForbidden) {
+		level.Debug(e.logger).Log("msg", "Not allowed to list prepared queries", "err", err)
+		return
+	}
+	e.recordQuery("prepared_queries", err)
+
+	if err != nil {
+		level.Error(e.logger).Log("msg", "Failed to query prepared queries", "err", err)
+		return
+	}
+
+	e.preparedQueries.WithLabelValues().Set(float64(len(queries)))
+	for _, query := range queries {
+		e.preparedQueryInfo.WithLabelValues(query.ID, query.Name, query.Service.Service).Set(1)
+	}
+}
+
+// setLicenseExpiry exports how long the Consul Enterprise license has left.
+func (e *Exporter) setLicenseExpiry(ctx context.Context) {
+	reply, err := e.client.Operator().LicenseGet(e.newManagementQueryOptions(ctx))
+	e.recordQuery("license", err)
+
+	if err != nil {
+		level.Error(e.logger).Log("msg", "Failed to query the license", "err", err)
+		return
+	}
+	if reply.License == nil {
+		level.Error(e.logger).Log("msg", "Consul returned no license")
+		return
+	}
+
+	e.licenseExpiry.WithLabelValues().Set(time.Until(reply.License.ExpirationTime).Seconds())
+}
+
+// setDatacenters exports the datacenters known through WAN federation and
+// whether each of them answers. The datacenters are asked all at once, after
+// every other query, and each gets half the time left in the scrape, so that
+// one that doesn't answer is reported as unreachable rather than failing the
+// whole scrape.
+func (e *Exporter) setDatacenters(ctx context.Context) {
+	datacenters, err := e.agentClient.Catalog().Datacenters()
+	e.recordQuery("datacenters", err)
+
+	if err != nil {
+		level.Error(e.logger).Log("msg", "Failed to query datacenters", "err", err)
+		return
+	}
+	e.datacenterCount.WithLabelValues().Set(float64(len(datacenters)))
+
+	pingCtx := ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		pingCtx, cancel = context.WithTimeout(ctx, time.Until(deadline)/2)
+		defer cancel()
+	}
+	var wg sync.WaitGroup
+	for _, dc := range datacenters {
+		wg.Add(1)
+		go func(dc string) {
+			defer wg.Done()
+			opts := e.newQueryOptions(pingCtx)
+			opts.Datacenter = dc
+			leader, err := e.client.Status().LeaderWithQueryOptions(opts)
+			if err != nil {
+				level.Debug(e.logger).Log("msg", "Datacenter is unreachable", "datacenter", dc, "err", err)
+			}
+			e.datacenterReachable.WithLabelValues(dc).Set(boolToFloat(err == nil && leader != ""))
+		}(dc)
+	}
+	wg.Wait()
+}
+
+// setIntentions exports how many Connect intentions allow or deny traffic.
+// Intentions with L7 permissions have no action of their own and are counted
+// with an empty action label.
+func (e *Exporter) setIntentions(ctx context.Context) {
+	intentions, _, err := e.client.Connect().Intentions(e.newManagementQueryOptions(ctx))
+	if hasStatusCode(err, http.StatusForbidden) {
+		level.Debug(e.logger).Log("msg", "Not allowed to list Connect intentions", "err", err)
+		return
+	}
+	e.recordQuery("intentions", err)
+
+	if err != nil {
+		level.Error(e.logger).Log("msg", "Failed to query Connect intentions", "err", err)
+		return
+	}
+
+	if e.exposeIntentions {
+		counts := map[consul_api.IntentionAction]int{
+			consul_api.IntentionActionAllow: 0,
+			consul_api.IntentionActionDeny:  0,
+		}
+		for _, intention := range intentions {
+			counts[intention.Action]++
+		}
+		for action, count := range counts {
+			e.intentions.WithLabelValues(string(action)).Set(float64(count))
+		}
+	}
+
+	// Only edges that touch a wanted service are exported, which lets the
+	// service filters bound the cardinality.
+	if e.exposeConnectTopology {
+		for _, intention := range intentions {
+			if !e.wantService(intention.SourceName) && !e.wantService(intention.DestinationName) {
+				continue
+			}
+			e.connectTopology.WithLabelValues(intention.SourceName, intention.DestinationName, string(intention.Action)).Set(1)
+		}
+	}
+}
+
+// setNetworkRTT exports the estimated round trip time from the agent we query
+// to every node in the same network segment.
+func (e *Exporter) setNetworkRTT(ctx context.Context) {
+	agentNode, err := e.agentClient.Agent().NodeName()
+	if err == nil {
+		var entries []*consul_api.CoordinateEntry
+		entries, _, err = e.client.Coordinate().Nodes(e.newQueryOptions(ctx))
+		if err == nil {
+			// Coordinates are only comparable within a segment, and the
+			// servers have one in each of them.
+			origins := make(map[string]*consul_api.CoordinateEntry)
+			for _, entry := range entries {
+				if entry.Node == agentNode {
+					origins[entry.Segment] = entry
+				}
+			}
+			for _, entry := range entries {
+				origin, ok := origins[entry.Segment]
+				if !ok || !origin.Coord.IsCompatibleWith(entry.Coord) {
+					continue
+				}
+				e.networkRTT.WithLabelValues(e.nodeLabel(entry.Node)).Set(origin.Coord.DistanceTo(entry.Coord).Seconds())
+			}
+		}
+	}
+	e.recordQuery("coordinates", err)
+
+	if err != nil {
+		level.Error(e.logger).Log("msg", "Failed to query network coordinates", "err", err)
+	}
+}
+
+// setAgentMetrics re-exports the agent's own telemetry whose names start with
+// one of the configured prefixes. Their names are only known once the agent
+// answers, so they are built as const metrics, served by an
+// agentMetricsCollector rather than by the exporter itself.
+//
+// The agent aggregates its metrics over short intervals: gauges are exported
+// as they are, counters as their sum and samples, such as timers, as their
+// mean over the current interval.
+func (e *Exporter) setAgentMetrics() {
+	info, err := e.agentClient.Agent().Metrics()
+	e.recordQuery("agent_metrics", err)
+
+	if err != nil {
+		level.Error(e.logger).Log("msg", "Failed to query agent metrics", "err", err)
+		return
+	}
+
+	seen := map[string]bool{}
+	add := func(name string, value float64, labels map[string]string) {
+		if !e.wantAgentMetric(name) {
+			return
+		}
+		fqName := prometheus.BuildFQName(e.metricsNamespace, "agent", invalidLabelChars.ReplaceAllString(strings.TrimPrefix(name, "consul."), "_"))
+
+		var labelNames, labelValues []string
+		for k := range labels {
+			labelNames = append(labelNames, k)
+		}
+		sort.Strings(labelNames)
+		for i, k := range labelNames {
+			labelValues = append(labelValues, labels[k])
+			labelNames[i] = invalidLabelChars.ReplaceAllString(k, "_")
+		}
+
+		// Different Consul names can map to the same metric.
+		key := fqName + "\xff" + strings.Join(labelNames, "\xff") + "\xff" + strings.Join(labelValues, "\xff")
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+
+		desc := prometheus.NewDesc(fqName, "Metric of the Consul agent.", labelNames, e.constLabels)
+		m, err := prometheus.NewConstMetric(desc, prometheus.GaugeValue, value, labelValues...)
+		if err != nil {
+			level.Debug(e.logger).Log("msg", "Skipping agent metric", "name", name, "err", err)
+			return
+		}
+		e.agentMetrics = append(e.agentMetrics, m)
+	}
+
+	for _, g := range info.Gauges {
+		add(g.Name, float64(g.Value), g.Labels)
+	}
+	for _, c := range info.Counters {
+		add(c.Name, c.Sum, c.Labels)
+	}
+	for _, s := range info.Samples {
+		add(s.Name, s.Mean, s.Labels)
+	}
+}
+
+// agentMetricsCollector serves the agent metrics of an exporter. It describes
+// nothing, which makes it an unchecked collector: its metrics can't be
+// described up front, unlike those of the exporter. It is to be gathered
+// after the exporter, through prometheus.Gatherers, so that it serves the
+// results of the scrape that collecting the exporter sets off.
+type agentMetricsCollector struct {
+	e *Exporter
+}
+
+// Describe implements prometheus.Collector.
+func (c agentMetricsCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect implements prometheus.Collector.
+func (c agentMetricsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.e.mutex.RLock()
+	metrics := c.e.results.agentMetrics
+	c.e.mutex.RUnlock()
+
+	for _, m := range metrics {
+		ch <- m
+	}
+}
+
+// wantAgentMetric reports whether an agent metric matches one of the
+// configured prefixes.
+func (e *Exporter) wantAgentMetric(name string) bool {
+	for _, prefix := range e.agentMetricPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasStatusCode reports whether err is an unexpected HTTP response from
+// Consul with one of the given status codes.
+func hasStatusCode(err error, codes ...int) bool {
+	var statusErr consul_api.StatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	for _, code := range codes {
+		if statusErr.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// nodeLabel returns the value of the node label for the named node: its name,
+// or its ID with -consul.node-label=id once the node has been listed.
+func (e *Exporter) nodeLabel(name string) string {
+	if id, ok := e.nodeIDs[name]; ok {
+		return id
+	}
+	return name
+}
+
+// wantService reports whether the health of the named service should be
+// queried and exported.
+func (e *Exporter) wantService(name string) bool {
+	if e.serviceInclude != nil && !e.serviceInclude.MatchString(name) {
+		return false
+	}
+	return e.serviceExclude == nil || !e.serviceExclude.MatchString(name)
+}
+
+// recordQuery notes whether the given kind of query against Consul succeeded.
+// Queries our token isn't allowed to make fail the same way on every scrape,
+// so they don't count against caching its results or last_scrape_error.
+func (e *Exporter) recordQuery(query string, err error) {
+	success := 1
+	if err != nil {
+		success = 0
+		if !hasStatusCode(err, http.StatusForbidden) {
+			e.queryFailed.Store(true)
+		}
+		e.scrapeErrors.WithLabelValues(query).Inc()
+	}
+	e.querySuccess.WithLabelValues(query).Set(float64(success))
+}
+
+func (e *Exporter) queryClient(ctx context.Context, services chan<- []*consul_api.ServiceEntry, checks chan<- []*consul_api.HealthCheck) {
+
+	defer close(services)
+	defer close(checks)
+
+	// How many peers are in the Consul cluster? The first server to answer
+	// is used for the rest of the scrape.
+	var peers []string
+	err := e.retry(ctx, "peers", func() (err error) {
+		peers, err = e.queryPeers(ctx)
+		return err
+	})
+	e.recordQuery("peers", err)
+
+	if err != nil {
+		e.up.Set(0)
+		level.Error(e.logger).Log("msg", "Failed to query Raft peers", "err", err)
+		return
+	}
+
+	// We'll use peers to decide that we're up. Failures of the queries below
+	// only show up in their own query_success series.
+	e.up.Set(1)
+	e.complete = true
+	e.ready.Store(true)
+	e.clusterServers.Set(float64(len(peers)))
+	// Consul answers, so it is up, but a cluster that is still bootstrapping
+	// or has lost its configuration has no peers yet.
+	if len(peers) == 0 {
+		level.Warn(e.logger).Log("msg", "Consul reports no Raft peers")
+	}
+
+	// A scrape of a single service leaves out the rest of the cluster.
+	if e.service != "" {
+		e.queryServiceHealth(ctx, map[string][]string{e.service: nil}, services)
+		return
+	}
+
+	// Which of them leads? One series per peer keeps the set of series
+	// stable across elections.
+	var leader string
+	err = e.retry(ctx, "leader", func() (err error) {
+		leader, err = e.client.Status().LeaderWithQueryOptions(e.newQueryOptions(ctx))
+		return err
+	})
+	e.recordQuery("leader", err)
+
+	if err != nil {
+		level.Error(e.logger).Log("msg", "Failed to query the Raft leader", "err", err)
+	} else {
+		for _, peer := range peers {
+			isLeader := 0
+			if peer == leader {
+				isLeader = 1
+			}
+			e.raftLeader.WithLabelValues(peer).Set(float64(isLeader))
+		}
+	}
+
+	// How many of them count towards the quorum?
+	raftConfig, err := e.client.Operator().RaftGetConfiguration(e.newManagementQueryOptions(ctx))
+	e.recordQuery("raft_configuration", err)
+
+	if err != nil {
+		level.Error(e.logger).Log("msg", "Failed to query the Raft configuration", "err", err)
+	} else {
+		voters := map[bool]int{true: 0, false: 0}
+		for _, server := range raftConfig.Servers {
+			voters[server.Voter]++
+		}
+		for voter, count := range voters {
+			e.raftConfigurationPeers.WithLabelValues(strconv.FormatBool(voter)).Set(float64(count))
+		}
+	}
+
+	// What does Autopilot think of the servers?
+	e.setAutopilotHealth(ctx)
+
+	// When does the Enterprise license run out?
+	if e.exposeLicense {
+		e.setLicenseExpiry(ctx)
+	}
+
+	// How many nodes are registered?
+	var nodes []*consul_api.Node
+	err = e.retry(ctx, "nodes", func() (err error) {
+		nodes, _, err = e.client.Catalog().Nodes(e.newQueryOptions(ctx))
+		return err
+	})
+	e.recordQuery("nodes", err)
+
+	if err != nil {
+		// Leave the node count out rather than reporting zero.
+		level.Error(e.logger).Log("msg", "Failed to query catalog nodes", "err", err)
+	} else {
+		e.nodeCount.WithLabelValues().Set(float64(len(nodes)))
+		if e.nodeLabelID {
+			nodeIDs := make(map[string]string, len(nodes))
+			for _, node := range nodes {
+				if node.ID != "" {
+					nodeIDs[node.Node] = node.ID
+				}
+			}
+			e.mutex.Lock()
+			e.nodeIDs = nodeIDs
+			e.mutex.Unlock()
+		}
+		if len(e.nodeMetaKeys) > 0 {
+			for _, node := range nodes {
+				values := []string{e.nodeLabel(node.Node)}
+				for _, key := range e.nodeMetaKeys {
+					values = append(values, node.Meta[key])
+				}
+				e.nodeMetadata.WithLabelValues(values...).Set(1)
+			}
+		}
+	}
+
+	// How many sessions does each node hold?
+	sessions, _, err := e.client.Session().List(e.newQueryOptions(ctx))
+	e.recordQuery("sessions", err)
+
+	if err != nil {
+		level.Error(e.logger).Log("msg", "Failed to query sessions", "err", err)
+	} else {
+		sessionCounts := make(map[string]int)
+		for _, session := range sessions {
+			sessionCounts[e.nodeLabel(session.Node)]++
+		}
+		for node, count := range sessionCounts {
+			e.sessions.WithLabelValues(node).Set(float64(count))
+		}
+	}
+
+	// Which prepared queries are defined?
+	e.setPreparedQueries(ctx)
+
+	// Which services may talk to each other?
+	if e.exposeIntentions || e.exposeConnectTopology {
+		e.setIntentions(ctx)
+	}
+
+	// How far away are the other nodes?
+	if e.exposeCoordinates && !e.remote {
+		e.setNetworkRTT(ctx)
+	}
+
+	// What does the agent report about itself and its gossip pools?
+	if !e.remote {
+		e.setAgentInfo(ctx)
+	}
+
+	// Query for the full list of services.
+	var serviceNames map[string][]string
+	var servicesMeta *consul_api.QueryMeta
+	err = e.retry(ctx, "services", func() (err error) {
+		serviceNames, servicesMeta, err = e.client.Catalog().Services(e.newQueryOptions(ctx))
+		return err
+	})
+	e.recordQuery("services", err)
+
+	if err != nil {
+		// Leave the service count out rather than reporting zero. The
+		// checks don't need the list of services, so go on with them.
+		level.Error(e.logger).Log("msg", "Failed to query catalog services", "err", err)
+	} else {
+		e.serviceCount.WithLabelValues().Set(float64(len(serviceNames)))
+		e.catalogLastIndex.WithLabelValues().Set(float64(servicesMeta.LastIndex))
+		e.queryLastContact.WithLabelValues().Set(servicesMeta.LastContact.Seconds())
+		e.queryKnownLeader.WithLabelValues().Set(boolToFloat(servicesMeta.KnownLeader))
+		for name := range serviceNames {
+			if e.wantService(name) {
+				e.serviceExists.WithLabelValues(name).Set(1)
+			}
+		}
+
+		if e.collectServiceEntries && !e.healthFromState {
+			e.queryServiceHealth(ctx, serviceNames, services)
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}
+
+	// The checks are needed for health from state even if they aren't
+	// exported themselves.
+	fromState := e.collectServiceEntries && e.healthFromState
+	if !e.collectChecks && !fromState {
+		return
+	}
+
+	var c_entries consul_api.HealthChecks
+	err = e.retry(ctx, "checks", func() (err error) {
+		c_entries, err = e.queryChecks(ctx)
+		return err
+	})
+	e.recordQuery("checks", err)
+	if err != nil {
+		level.Error(e.logger).Log("msg", "Failed to query health checks", "err", err)
+
+	} else {
+		if fromState {
+			for name, s_entries := range serviceEntriesFromChecks(c_entries) {
+				if e.wantService(name) {
+					services <- s_entries
+				}
+			}
+		}
+		if e.collectChecks {
+			checks <- c_entries
+		}
+	}
 
-	e.keyValues.Reset()
-	e.setKeyValues()
-	e.keyValues.Collect(ch)
 }
 
-func (e *Exporter) queryClient(services chan<- []*consul_api.ServiceEntry, checks chan<- []*consul_api.HealthCheck) {
+// queryChecks fetches the health checks of the nodes given to -consul.node,
+// or of the whole cluster.
+func (e *Exporter) queryChecks(ctx context.Context) (consul_api.HealthChecks, error) {
+	if len(e.nodes) == 0 {
+		checks, _, err := e.client.Health().State("any", e.newQueryOptions(ctx))
+		return checks, err
+	}
+	var checks consul_api.HealthChecks
+	for _, node := range e.nodes {
+		nodeChecks, _, err := e.client.Health().Node(node, e.newQueryOptions(ctx))
+		if err != nil {
+			return nil, err
+		}
+		checks = append(checks, nodeChecks...)
+	}
+	return checks, nil
+}
 
-	defer close(services)
-	defer close(checks)
+// queryPeers asks each server in turn for the Raft peers, and uses the first
+// one that answers for the rest of the scrape.
+func (e *Exporter) queryPeers(ctx context.Context) ([]string, error) {
+	var err error
+	for _, server := range e.servers {
+		var peers []string
+		peers, err = server.client.Status().PeersWithQueryOptions(e.newQueryOptions(ctx))
+		if err == nil {
+			e.mutex.Lock()
+			e.client = server.client
+			e.agentClient = server.agentClient
+			e.mutex.Unlock()
+			e.activeServer.WithLabelValues(server.address).Set(1)
+			return peers, nil
+		}
+		if len(e.servers) > 1 {
+			level.Warn(e.logger).Log("msg", "Consul server didn't answer, trying the next one", "server", server.address, "err", err)
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
 
-	// How many peers are in the Consul cluster?
-	peers, err := e.client.Status().Peers()
+// retry calls f until it succeeds, retrying transient errors up to
+// -consul.retries times. The interval between attempts starts at
+// -consul.retry-interval and doubles every time, and retries stop short of
+// running past the scrape timeout.
+func (e *Exporter) retry(ctx context.Context, query string, f func() error) error {
+	err := e.timeQuery(query, f)
+	interval := e.retryInterval
+	for i := 0; i < e.retries && err != nil; i++ {
+		// Consul answering means it will most likely answer the same way.
+		var statusErr consul_api.StatusError
+		if errors.As(err, &statusErr) && statusErr.Code < http.StatusInternalServerError {
+			break
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < interval {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(interval):
+		}
+		interval *= 2
 
-	if err != nil {
-		e.up.Set(0)
-		log.Errorf("Query error is %v", err)
-		return
+		e.retriesTotal.WithLabelValues(query).Inc()
+		level.Debug(e.logger).Log("msg", "Retrying query", "query", query, "err", err)
+		err = e.timeQuery(query, f)
 	}
+	return err
+}
 
-	// We'll use peers to decide that we're up.
-	e.up.Set(1)
-	e.clusterServers.Set(float64(len(peers)))
-
-	// How many nodes are registered?
-	nodes, _, err := e.client.Catalog().Nodes(&consul_api.QueryOptions{})
+// timeQuery runs f and records how long it took as a query of this kind.
+func (e *Exporter) timeQuery(query string, f func() error) error {
+	start := time.Now()
+	err := f()
+	e.queryDuration.WithLabelValues(query).Observe(time.Since(start).Seconds())
+	return err
+}
 
-	if err != nil {
-		// FIXME: How should we handle a partial failure like this?
-	} else {
-		e.nodeCount.Set(float64(len(nodes)))
+// queryServiceHealth queries the health of every wanted service, fanning the
+// queries out over a bounded pool of workers.
+func (e *Exporter) queryServiceHealth(ctx context.Context, serviceNames map[string][]string, services chan<- []*consul_api.ServiceEntry) {
+	// Any failing service marks the whole health query as failed.
+	e.recordQuery("health", nil)
+	names := make(chan string)
+	workers := e.concurrentRequests
+	if workers < 1 {
+		workers = 1
 	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s := range names {
+				var s_entries []*consul_api.ServiceEntry
+				err := e.timeQuery("health", func() (err error) {
+					s_entries, _, err = e.client.Health().Service(s, "", false, e.newQueryOptions(ctx))
+					return err
+				})
 
-	// Query for the full list of services.
-	serviceNames, _, err := e.client.Catalog().Services(&consul_api.QueryOptions{})
-	e.serviceCount.Set(float64(len(serviceNames)))
+				if err != nil {
+					e.recordQuery("health", err)
+					level.Error(e.logger).Log("msg", "Failed to query service health", "service", s, "err", err)
+					continue
+				}
 
-	if err != nil {
-		// FIXME: How should we handle a partial failure like this?
-		return
+				services <- s_entries
+			}
+		}()
 	}
 
-	e.serviceCount.Set(float64(len(serviceNames)))
-
 	for s := range serviceNames {
-		s_entries, _, err := e.client.Health().Service(s, "", false, &consul_api.QueryOptions{})
-
-		if err != nil {
-			log.Errorf("Failed to query service health: %v", err)
+		if ctx.Err() != nil {
+			break
+		}
+		if !e.wantService(s) {
 			continue
 		}
-
-		services <- s_entries
+		names <- s
 	}
+	close(names)
+	wg.Wait()
+}
 
-	c_entries, _, err := e.client.Health().State("any", &consul_api.QueryOptions{})
-	if err != nil {
-		log.Errorf("Failed to query service health: %v", err)
+// serviceEntriesFromChecks rebuilds the service entries Health().Service
+// would return, grouped by service name, from the checks of the whole cluster.
+// Only what checks carry is known about each instance: its node and its
+// service's ID, name and tags. Instances without any check of their own are
+// missing.
+func serviceEntriesFromChecks(checks []*consul_api.HealthCheck) map[string][]*consul_api.ServiceEntry {
+	type instanceKey struct {
+		node, serviceID string
+	}
 
-	} else {
-		checks <- c_entries
+	nodeChecks := map[string]consul_api.HealthChecks{}
+	for _, hc := range checks {
+		if hc.ServiceID == "" {
+			nodeChecks[hc.Node] = append(nodeChecks[hc.Node], hc)
+		}
 	}
 
+	instances := map[instanceKey]*consul_api.ServiceEntry{}
+	services := map[string][]*consul_api.ServiceEntry{}
+	for _, hc := range checks {
+		if hc.ServiceID == "" {
+			continue
+		}
+		key := instanceKey{node: hc.Node, serviceID: hc.ServiceID}
+		entry, ok := instances[key]
+		if !ok {
+			// Like Health().Service, node checks come first.
+			entry = &consul_api.ServiceEntry{
+				Node: &consul_api.Node{Node: hc.Node},
+				Service: &consul_api.AgentService{
+					ID:      hc.ServiceID,
+					Service: hc.ServiceName,
+					Tags:    hc.ServiceTags,
+				},
+				Checks: append(consul_api.HealthChecks{}, nodeChecks[hc.Node]...),
+			}
+			instances[key] = entry
+			services[hc.ServiceName] = append(services[hc.ServiceName], entry)
+		}
+		entry.Checks = append(entry.Checks, hc)
+	}
+	return services
 }
 
 func (e *Exporter) setMetrics(services <-chan []*consul_api.ServiceEntry, checks <-chan []*consul_api.HealthCheck) {
 
 	// Each service will be an array of ServiceEntry structs.
-	running := true
-	for running {
+	nodeServices := map[string]int{}
+	// Keep going until both channels are closed. A closed channel is set to
+	// nil so that it no longer delivers empty values.
+	for services != nil || checks != nil {
 		select {
-		case service, b := <-services:
-			running = b
+		case service, ok := <-services:
+			if !ok {
+				services = nil
+				continue
+			}
 			if len(service) == 0 {
 				// Not sure this should ever happen, but catch it just in case...
 				continue
@@ -234,7 +2598,16 @@ func (e *Exporter) setMetrics(services <-chan []*consul_api.ServiceEntry, checks
 			// We should have one ServiceEntry per node, so use that for total nodes.
 			e.serviceNodesTotal.WithLabelValues(service[0].Service.Service).Set(float64(len(service)))
 
+			unhealthy := 0
+			gateways := map[consul_api.ServiceKind]int{}
+
+			tagNodes := map[string]int{}
+			// A service may run several instances on the same node, which
+			// is only healthy when all of them are.
+			healthy := map[string]int{}
+			nodeChecks := map[string]consul_api.HealthChecks{}
 			for _, entry := range service {
+				node := e.nodeLabel(entry.Node.Node)
 				// We have a Node, a Service, and one or more Checks. Our
 				// service-node combo is passing if all checks have a `status`
 				// of "passing."
@@ -242,79 +2615,887 @@ func (e *Exporter) setMetrics(services <-chan []*consul_api.ServiceEntry, checks
 				passing := 1
 
 				for _, hc := range entry.Checks {
-					if hc.Status != consul.HealthPassing {
+					if !e.isPassing(hc.Status) {
 						passing = 0
 						break
 					}
 				}
 
-				log.Infof("%v/%v status is %v", entry.Service.Service, entry.Node.Node, passing)
+				level.Debug(e.logger).Log("msg", "Service health", "service", entry.Service.Service, "node", node, "status", passing)
+
+				unhealthy += 1 - passing
+
+				if _, ok := healthy[node]; !ok {
+					healthy[node] = 1
+					nodeServices[node]++
+				}
+				healthy[node] *= passing
+				nodeChecks[node] = append(nodeChecks[node], entry.Checks...)
+
+				if e.exposeTags {
+					seen := map[string]bool{}
+					for _, tag := range entry.Service.Tags {
+						if e.collectServiceInstances {
+							e.serviceTags.WithLabelValues(entry.Service.Service, node, tag).Set(1)
+						}
+						if !seen[tag] {
+							seen[tag] = true
+							tagNodes[tag]++
+						}
+					}
+				}
+
+				// Checks don't tell where a service is registered.
+				if !e.healthFromState && e.collectServiceInstances {
+					address := entry.Service.Address
+					if address == "" {
+						address = entry.Node.Address
+					}
+					e.servicePort.WithLabelValues(entry.Service.Service, node).Set(float64(entry.Service.Port))
+					e.serviceAddress.WithLabelValues(entry.Service.Service, node, address).Set(1)
+
+					// Consul fills in weights of 1 for services that set none.
+					weights := entry.Service.Weights
+					if weights.Passing == 0 && weights.Warning == 0 {
+						weights = consul_api.AgentWeights{Passing: 1, Warning: 1}
+					}
+					e.serviceWeight.WithLabelValues(entry.Service.Service, node, consul_api.HealthPassing).Set(float64(weights.Passing))
+					e.serviceWeight.WithLabelValues(entry.Service.Service, node, consul_api.HealthWarning).Set(float64(weights.Warning))
+				}
+				if !e.healthFromState {
+					gateways[entry.Service.Kind]++
+				}
+
+				if len(e.serviceMetaKeys) > 0 && e.collectServiceInstances {
+					values := []string{entry.Service.Service, node}
+					for _, key := range e.serviceMetaKeys {
+						values = append(values, entry.Service.Meta[key])
+					}
+					e.serviceMetadata.WithLabelValues(values...).Set(1)
+				}
+			}
+
+			for node, passing := range healthy {
+				e.serviceNodesHealthy.WithLabelValues(service[0].Service.Service, node).Set(float64(passing))
+				if !e.collectServiceInstances {
+					continue
+				}
+
+				status := aggregateStatus(nodeChecks[node])
+				for _, st := range healthStatuses {
+					value := 0
+					if st == status {
+						value = 1
+					}
+					e.serviceNodesStatus.WithLabelValues(service[0].Service.Service, node, st).Set(float64(value))
+				}
+			}
+
+			// Adding creates the series at 0, so it is only missing when
+			// no service could be queried.
+			e.unhealthyInstances.WithLabelValues().Add(float64(unhealthy))
+			if !e.healthFromState {
+				for _, kind := range gatewayKinds {
+					e.meshGateways.WithLabelValues(string(kind)).Add(float64(gateways[kind]))
+				}
+			}
 
-				e.serviceNodesHealthy.WithLabelValues(entry.Service.Service, entry.Node.Node).Set(float64(passing))
+			for tag, count := range tagNodes {
+				e.serviceTagNodes.WithLabelValues(service[0].Service.Service, tag).Set(float64(count))
+			}
+		case entry, ok := <-checks:
+			if !ok {
+				checks = nil
+				continue
 			}
-		case entry, b := <-checks:
-			running = b
+			failing := map[string]int{}
+			types := map[string]int{}
+			statuses := map[string]int{}
 			for _, hc := range entry {
+				node := e.nodeLabel(hc.Node)
+				types[hc.Type]++
+				statuses[aggregateStatus(consul_api.HealthChecks{hc})]++
+
+				// Nodes with only passing checks are still reported, as 0.
+				// Maintenance is intentional, so it doesn't count as failing.
+				count := failing[node]
+				switch {
+				case hc.CheckID == consul_api.NodeMaint:
+					e.nodeMaintenance.WithLabelValues(node).Set(1)
+				case strings.HasPrefix(hc.CheckID, consul_api.ServiceMaintPrefix):
+					e.serviceMaintenance.WithLabelValues(hc.ServiceName, node).Set(1)
+				case !e.isPassing(hc.Status):
+					count++
+				}
+				failing[node] = count
+
+				// Only the failing checks may be wanted, to save series.
+				if e.checkStates != nil && !e.checkStates[hc.Status] {
+					continue
+				}
 				passing := 1
+				if !e.isPassing(hc.Status) {
+					passing = 0
+				}
 				if hc.ServiceID == "" {
-					if hc.Status != consul.HealthPassing {
-						passing = 0
-					}
-					e.nodeChecks.WithLabelValues(hc.CheckID, hc.Node).Set(float64(passing))
-					log.Infof("CHECKS: %v/%v status is %d", hc.CheckID, hc.Node, passing)
+					e.nodeChecks.WithLabelValues(hc.CheckID, node).Set(float64(passing))
+					level.Debug(e.logger).Log("msg", "Node check", "check", hc.CheckID, "node", node, "status", passing)
+				} else {
+					e.serviceChecks.WithLabelValues(hc.CheckID, node, hc.ServiceName).Set(float64(passing))
+					level.Debug(e.logger).Log("msg", "Service check", "check", hc.CheckID, "node", node, "service", hc.ServiceName, "status", passing)
 				}
 			}
+			for node, count := range failing {
+				e.nodeChecksFailing.WithLabelValues(node).Set(float64(count))
+			}
+			for checkType, count := range types {
+				e.checksByType.WithLabelValues(checkType).Set(float64(count))
+			}
+			for _, st := range healthStatuses {
+				e.healthChecks.WithLabelValues(st).Set(float64(statuses[st]))
+			}
+			if e.exposeCheckOutput {
+				e.setCheckUpdates(entry)
+			}
+			if e.exposeDeregisterCritical {
+				e.setDeregisterCritical(entry)
+			}
+		}
+	}
+
+	for node, count := range nodeServices {
+		e.nodeServices.WithLabelValues(node).Set(float64(count))
+	}
+}
+
+// setCheckUpdates exports when each check last changed. Consul doesn't keep
+// timestamps for checks, but bumps their ModifyIndex whenever a new status or
+// output is synced to the catalog, so note the time a new index shows up.
+func (e *Exporter) setCheckUpdates(checks []*consul_api.HealthCheck) {
+	now := time.Now()
+	updates := make(map[checkKey]checkUpdate, len(checks))
+	for _, hc := range checks {
+		key := checkKey{node: hc.Node, check: hc.CheckID}
+		update, ok := e.checkUpdates[key]
+		if !ok || update.modifyIndex != hc.ModifyIndex {
+			update = checkUpdate{modifyIndex: hc.ModifyIndex, seen: now}
+		}
+		updates[key] = update
+		e.checkLastUpdate.WithLabelValues(hc.CheckID, e.nodeLabel(hc.Node)).Set(float64(update.seen.Unix()))
+	}
+	// Forget about checks that are gone.
+	e.checkUpdates = updates
+}
+
+// setDeregisterCritical exports how long the critical services that are set
+// to be deregistered have left. Consul doesn't tell when a check turned
+// critical either, so count from when it was first seen critical.
+func (e *Exporter) setDeregisterCritical(checks []*consul_api.HealthCheck) {
+	now := time.Now()
+	since := map[checkKey]time.Time{}
+	for _, hc := range checks {
+		after := hc.Definition.DeregisterCriticalServiceAfterDuration
+		if hc.ServiceID == "" || after <= 0 || hc.Status != consul_api.HealthCritical {
+			continue
 		}
+		key := checkKey{node: hc.Node, check: hc.CheckID}
+		start, ok := e.criticalSince[key]
+		if !ok {
+			start = now
+		}
+		since[key] = start
+
+		left := after - now.Sub(start)
+		if left < 0 {
+			left = 0
+		}
+		e.deregisterCritical.WithLabelValues(hc.CheckID, e.nodeLabel(hc.Node), hc.ServiceName).Set(left.Seconds())
 	}
+	// Forget about checks that recovered or are gone.
+	e.criticalSince = since
+}
 
+// isPassing reports whether a check with the given status counts as passing.
+func (e *Exporter) isPassing(status string) bool {
+	return status == consul_api.HealthPassing || (e.warningAsHealthy && status == consul_api.HealthWarning)
+}
+
+// aggregateStatus returns the most severe status among the given checks.
+// Checks that put a node or service into maintenance are reported as
+// "maintenance" rather than by the critical status Consul gives them.
+func aggregateStatus(checks consul_api.HealthChecks) string {
+	severity := 0
+	for _, hc := range checks {
+		status := hc.Status
+		if hc.CheckID == consul_api.NodeMaint || strings.HasPrefix(hc.CheckID, consul_api.ServiceMaintPrefix) {
+			status = consul_api.HealthMaint
+		}
+		for i, st := range healthStatuses {
+			if st == status && i > severity {
+				severity = i
+			}
+		}
+	}
+	return healthStatuses[severity]
 }
 
-func (e *Exporter) setKeyValues() {
-	if e.kvPrefix == "" {
+func (e *Exporter) setKeyValues(ctx context.Context) {
+	if !e.collectKV || len(e.kvPrefixes) == 0 {
 		return
 	}
 
 	kv := e.client.KV()
 
-	pairs, _, err := kv.List(e.kvPrefix, &consul_api.QueryOptions{})
+	// Prefixes may overlap, so only export each key once.
+	seen := map[string]bool{}
+
+	// Any failing prefix marks the whole KV query as failed.
+	e.recordQuery("kv", nil)
+	for _, p := range e.kvPrefixes {
+		var pairs consul_api.KVPairs
+		err := e.timeQuery("kv", func() (err error) {
+			pairs, _, err = kv.List(p.prefix, e.newQueryOptions(ctx))
+			return err
+		})
+		if err != nil {
+			e.recordQuery("kv", err)
+			e.kvListSuccess.WithLabelValues(p.prefix).Set(0)
+			level.Error(e.logger).Log("msg", "Error fetching key/values", "prefix", p.prefix, "err", err)
+			continue
+		}
+		e.kvListSuccess.WithLabelValues(p.prefix).Set(1)
+		e.kvKeys.WithLabelValues(p.prefix).Set(float64(len(pairs)))
+		if len(pairs) == 0 {
+			level.Debug(e.logger).Log("msg", "No keys under prefix", "prefix", p.prefix)
+		}
+
+		for _, pair := range pairs {
+			if seen[pair.Key] || !p.filter.MatchString(pair.Key) {
+				continue
+			}
+			seen[pair.Key] = true
+			e.kvFlags.WithLabelValues(pair.Key).Set(float64(pair.Flags))
+
+			if e.kvInfoMode {
+				e.kvInfo.WithLabelValues(pair.Key, kvInfoValue(pair.Value)).Set(1)
+				continue
+			}
+
+			val, err := parseKVValue(e.kvParseMode, string(pair.Value))
+			if err != nil {
+				mapped, ok := e.kvValueMap[string(pair.Value)]
+				if !ok {
+					e.kvUnparsable.WithLabelValues(pair.Key).Set(1)
+					continue
+				}
+				val = mapped
+			}
+			if val < e.kvMin || val > e.kvMax {
+				continue
+			}
+			e.keyValues.WithLabelValues(pair.Key).Set(val)
+		}
+	}
+}
+
+// kvInfoValue turns a KV value into a label value of consul_kv_info, cut
+// short after kvInfoMaxValueLength bytes.
+func kvInfoValue(value []byte) string {
+	if len(value) > kvInfoMaxValueLength {
+		value = value[:kvInfoMaxValueLength]
+	}
+	// Label values have to be valid UTF-8, which binary values or a cut in
+	// the middle of a character are not.
+	return strings.ToValidUTF8(string(value), "\uFFFD")
+}
+
+// parseKVValue parses a KV value as a number according to -kv.parse-mode.
+// Integers are decimal unless they start with a 0x, 0o or 0b prefix, such as
+// 0x1f, so that 010 is 10 as it is in float mode.
+func parseKVValue(mode, s string) (float64, error) {
+	if mode == "float" {
+		return strconv.ParseFloat(s, 64)
+	}
+	base := 10
+	if digits := strings.TrimLeft(s, "+-"); len(digits) > 1 && digits[0] == '0' && strings.ContainsRune("xXoObB", rune(digits[1])) {
+		base = 0
+	}
+	i, err := strconv.ParseInt(s, base, 64)
+	if err != nil && mode == "auto" {
+		return strconv.ParseFloat(s, 64)
+	}
+	return float64(i), err
+}
+
+// parseKVPrefixes compiles the filters of the given -kv.prefix values. Each
+// value is either a bare prefix, which uses defaultFilter, or prefix=regex.
+func parseKVPrefixes(prefixes []string, defaultFilter string) ([]kvPrefix, error) {
+	var parsed []kvPrefix
+	for _, value := range prefixes {
+		prefix, filter := value, defaultFilter
+		if i := strings.Index(value, "="); i >= 0 {
+			prefix, filter = value[:i], value[i+1:]
+		}
+		re, err := regexp.Compile(filter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid KV filter for prefix %q: %s", prefix, err)
+		}
+		parsed = append(parsed, kvPrefix{prefix: prefix, filter: re})
+	}
+	return parsed, nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+var (
+	invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+	validNamespace    = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+)
+
+// metaLabelNames appends a meta_<key> label name for each of the given meta
+// keys to labels, replacing characters that aren't allowed in label names.
+func metaLabelNames(labels []string, keys []string) ([]string, error) {
+	seen := map[string]string{}
+	for _, key := range keys {
+		name := "meta_" + invalidLabelChars.ReplaceAllString(key, "_")
+		if other, ok := seen[name]; ok {
+			return nil, fmt.Errorf("meta keys %q and %q both map to label %q", other, key, name)
+		}
+		seen[name] = key
+		labels = append(labels, name)
+	}
+	return labels, nil
+}
+
+// parseValueMap parses a comma-separated list of value=number pairs, as
+// given to -kv.value-map.
+func parseValueMap(s string) (map[string]float64, error) {
+	m := map[string]float64{}
+	if s == "" {
+		return m, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		i := strings.LastIndex(pair, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid KV value mapping %q, expected value=number", pair)
+		}
+		val, err := strconv.ParseFloat(pair[i+1:], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid KV value mapping %q: %s", pair, err)
+		}
+		m[pair[:i]] = val
+	}
+	return m, nil
+}
+
+// loadConfigFile sets the flags that weren't given on the command line from
+// the YAML document at path, which maps flag names to their values. Lists
+// are joined with commas for the flags that take comma-separated values, and
+// set one item at a time for the flags that can be repeated.
+func loadConfigFile(path string) error {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		log.Errorf("Error fetching key/values: %s", err)
-		return
+		return err
+	}
+	var config map[string]interface{}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return err
+	}
+
+	given := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	names := make([]string, 0, len(config))
+	for name := range config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := flag.Lookup(name)
+		if f == nil || name == "config.file" {
+			return fmt.Errorf("unknown option %q", name)
+		}
+		if given[name] {
+			continue
+		}
+		var values []string
+		switch v := config[name].(type) {
+		case nil:
+			values = []string{""}
+		case []interface{}:
+			for _, item := range v {
+				values = append(values, fmt.Sprint(item))
+			}
+		case map[string]interface{}:
+			return fmt.Errorf("option %q must be a single value or a list", name)
+		default:
+			values = []string{fmt.Sprint(v)}
+		}
+		if _, repeatable := f.Value.(*stringsFlag); !repeatable {
+			values = []string{strings.Join(values, ",")}
+		}
+		for _, value := range values {
+			if err := flag.Set(name, value); err != nil {
+				return fmt.Errorf("invalid value for option %q: %s", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// exporterSet holds the exporters of main. Those whose datacenter couldn't be
+// looked up at startup join it later.
+type exporterSet struct {
+	mtx       sync.RWMutex
+	exporters []*Exporter
+}
+
+func (s *exporterSet) add(e *Exporter) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.exporters = append(s.exporters, e)
+}
+
+func (s *exporterSet) list() []*Exporter {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.exporters
+}
+
+// retryNewExporter keeps trying to set up an exporter whose datacenter
+// couldn't be looked up, until it works or ctx is done. In the meantime,
+// consul_up reports Consul as down, with an empty dc label: a registry
+// insists on the same label names for the same metric throughout. The
+// exporter is registered in its place once it is set up.
+func retryNewExporter(ctx context.Context, opts consulOpts, expOpts exporterOpts, logger log.Logger) *Exporter {
+	constLabels := prometheus.Labels{"dc": ""}
+	if opts.namespace != "" {
+		constLabels["namespace"] = opts.namespace
+	}
+	if opts.partition != "" {
+		constLabels["partition"] = opts.partition
+	}
+	up := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   expOpts.metricsNamespace,
+		Name:        "up",
+		Help:        "Was the last query of Consul successful.",
+		ConstLabels: constLabels,
+	})
+	prometheus.MustRegister(up)
+
+	ticker := time.NewTicker(datacenterRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		exporter, err := NewExporter(opts, expOpts, logger)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error creating the exporter", "retry_in", datacenterRetryInterval, "err", err)
+			continue
+		}
+		prometheus.Unregister(up)
+		prometheus.MustRegister(exporter)
+		agentMetricsRegistry.MustRegister(agentMetricsCollector{exporter})
+		level.Info(logger).Log("msg", "Created the exporter", "dc", exporter.datacenter)
+		return exporter
 	}
+}
+
+// serviceMetricsHandler serves the metrics of exporters, the ones registered
+// by main, or, when the request names a service in its service parameter,
+// those of fresh exporters that only query and export the health of that
+// service. These share the Consul clients, and so the connections and rate
+// limit, of exporters.
+func serviceMetricsHandler(opts consulOpts, expOpts exporterOpts, exporters *exporterSet, logger log.Logger) http.Handler {
+	// Each scoped request queries Consul itself, right away.
+	opts.cacheTTL = 0
+	opts.watch = false
+	opts.scrapeInterval = 0
+	expOpts.collectKV = false
 
-	for _, pair := range pairs {
-		if e.kvFilter.MatchString(pair.Key) {
-			val, err := strconv.ParseFloat(string(pair.Value), 64)
-			if err == nil {
-				e.keyValues.WithLabelValues(pair.Key).Set(val)
+	defaultHandler := promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, promhttp.HandlerFor(
+		prometheus.Gatherers{prometheus.DefaultGatherer, agentMetricsRegistry},
+		promhttp.HandlerOpts{},
+	))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		service := r.URL.Query().Get("service")
+		if service == "" {
+			defaultHandler.ServeHTTP(w, r)
+			return
+		}
+
+		registry := prometheus.NewRegistry()
+		for _, exporter := range exporters.list() {
+			scoped, err := exporter.scopedTo(opts, expOpts, service)
+			if err != nil {
+				level.Error(logger).Log("msg", "Error creating the exporter", "dc", exporter.datacenter, "service", service, "err", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
 			}
+			registry.MustRegister(scoped)
 		}
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+}
+
+// scopedTo returns an exporter for the same datacenter as e, through the same
+// Consul clients, that only queries and exports the health of service.
+func (e *Exporter) scopedTo(opts consulOpts, expOpts exporterOpts, service string) (*Exporter, error) {
+	opts.datacenter = e.queryOptions.Datacenter
+	expOpts.serviceInclude = "^" + regexp.QuoteMeta(service) + "$"
+	scoped, err := newExporter(opts, expOpts, e.servers, e.datacenter, e.remote, e.logger)
+	if err != nil {
+		return nil, err
+	}
+	scoped.service = service
+
+	// Nodes aren't listed for a single service, so borrow e's node IDs.
+	e.mutex.RLock()
+	scoped.nodeIDs = e.nodeIDs
+	e.mutex.RUnlock()
+	return scoped, nil
+}
+
+// probeHandler serves the metrics of the Consul cluster at the address given
+// in the target parameter, which must be one of allowed. The exporter of each
+// target is kept across requests so that its clients and connections are
+// reused.
+func probeHandler(opts consulOpts, expOpts exporterOpts, allowed []string, logger log.Logger) http.Handler {
+	// The datacenter of each target is looked up from its agent.
+	opts.datacenter = ""
+	opts.watch = false
+	opts.scrapeInterval = 0
+
+	allowedTargets := make(map[string]bool, len(allowed))
+	for _, target := range allowed {
+		allowedTargets[target] = true
+	}
+	// Each target is set up on its first probe, under its own lock, so that
+	// one that is slow to answer doesn't hold up the others.
+	type probeTarget struct {
+		mtx      sync.Mutex
+		gatherer prometheus.Gatherer
 	}
+	var mtx sync.Mutex
+	targets := map[string]*probeTarget{}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := r.URL.Query().Get("target")
+		if target == "" {
+			http.Error(w, "The target parameter is missing", http.StatusBadRequest)
+			return
+		}
+		if !allowedTargets[target] {
+			http.Error(w, fmt.Sprintf("Target %q is not in -consul.allowed-targets", target), http.StatusForbidden)
+			return
+		}
+
+		mtx.Lock()
+		t, ok := targets[target]
+		if !ok {
+			t = &probeTarget{}
+			targets[target] = t
+		}
+		mtx.Unlock()
+
+		t.mtx.Lock()
+		if t.gatherer == nil {
+			targetOpts := opts
+			targetOpts.uri = target
+			exporter, err := NewExporter(targetOpts, expOpts, logger)
+			if err != nil {
+				t.mtx.Unlock()
+				level.Error(logger).Log("msg", "Error creating the exporter", "target", target, "err", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			registry, agentRegistry := prometheus.NewRegistry(), prometheus.NewRegistry()
+			registry.MustRegister(exporter)
+			agentRegistry.MustRegister(agentMetricsCollector{exporter})
+			t.gatherer = prometheus.Gatherers{registry, agentRegistry}
+		}
+		gatherer := t.gatherer
+		t.mtx.Unlock()
+		promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+}
+
+// basicAuth wraps h so that it requires the given HTTP basic auth
+// credentials, comparing them in constant time.
+func basicAuth(h http.Handler, username, password string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		userOK := subtle.ConstantTimeCompare([]byte(user), []byte(username)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(password)) == 1
+		if !ok || !userOK || !passOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Consul Exporter"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
 }
 
 func main() {
 	var (
+		showVersion   = flag.Bool("version", false, "Print version information and exit.")
 		listenAddress = flag.String("web.listen-address", ":9107", "Address to listen on for web interface and telemetry.")
 		metricsPath   = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
-		consulServer  = flag.String("consul.server", "localhost:8500", "HTTP API address of a Consul server or agent.")
-		kvPrefix      = flag.String("kv.prefix", "", "Prefix from which to expose key/value pairs.")
-		kvFilter      = flag.String("kv.filter", ".*", "Regex that determines which keys to expose.")
+		tlsCertFile   = flag.String("web.tls-cert-file", "", "Path to a PEM-encoded certificate to serve the web interface and telemetry over HTTPS. Requires -web.tls-key-file.")
+		tlsKeyFile    = flag.String("web.tls-key-file", "", "Path to the PEM-encoded private key for -web.tls-cert-file.")
+		authUsername  = flag.String("web.auth-username", "", "Username required to access the telemetry path. Enables HTTP basic auth, and needs -web.auth-password or -web.auth-password-file.")
+		authPassword  = flag.String("web.auth-password", "", "Password required along with -web.auth-username.")
+		enablePprof   = flag.Bool("web.enable-pprof", false, "Serve Go profiling data under /debug/pprof/, behind basic auth if it is enabled.")
+		authPassFile  = flag.String("web.auth-password-file", "", "File holding the password required along with -web.auth-username, so it doesn't appear on the command line.")
+		pageTitle     = flag.String("web.page-title", "Consul Exporter", "Title of the landing page, to tell exporters behind the same proxy apart.")
+
+		opts          = consulOpts{}
+		expOpts       = exporterOpts{}
+		promlogConfig = &promlog.Config{
+			Level:  &promlog.AllowedLevel{},
+			Format: &promlog.AllowedFormat{},
+		}
 	)
+	promlogConfig.Level.Set("info")
+	promlogConfig.Format.Set("logfmt")
+	flag.Var(promlogConfig.Level, "log.level", "Only log messages with the given severity or above. One of: [debug, info, warn, error]")
+	flag.Var(promlogConfig.Format, "log.format", "Output format of log messages. One of: [logfmt, json]")
+	flag.StringVar(&expOpts.metricsNamespace, "metrics.namespace", defaultNamespace, "Prefix of the names of all exported metrics.")
+	flag.BoolVar(&expOpts.collectKV, "collector.kv", true, "Query and export the key/value pairs selected by -kv.prefix.")
+	flag.BoolVar(&expOpts.collectServiceEntries, "collector.service-entries", true, "Query the health of every service and export the metrics of service instances, which make at least one series per service and node it runs on.")
+	flag.BoolVar(&expOpts.collectServiceInstances, "collector.service-instances", true, "Export the metrics of -collector.service-entries that go beyond consul_catalog_service_nodes and consul_catalog_service_node_healthy, such as consul_catalog_service_node_status and consul_service_port, each one or more series per service and node.")
+	flag.BoolVar(&expOpts.collectChecks, "collector.checks", true, "Query every health check and export the metrics of checks.")
+	flag.StringVar(&opts.uri, "consul.server", "", "HTTP API address of a Consul server or agent, or unix:///path/to/socket. Give a comma-separated list to fail over between several servers in order. Overrides $CONSUL_HTTP_ADDR, which defaults to localhost:8500.")
+	flag.StringVar(&opts.scheme, "consul.scheme", "", "Scheme to use for the Consul HTTP API. Overrides $CONSUL_HTTP_SSL, and defaults to https when any TLS flag is set.")
+	flag.StringVar(&opts.token, "consul.token", "", "ACL token to use for Consul API requests. Overrides $CONSUL_HTTP_TOKEN.")
+	flag.StringVar(&opts.managementToken, "consul.management-token", "", "ACL token to use instead of -consul.token for the Autopilot, Raft configuration, prepared query and intention endpoints, which need more than read access.")
+	flag.StringVar(&opts.caFile, "consul.ca-file", "", "File path to a PEM-encoded certificate authority used to validate the authenticity of a server certificate. Overrides $CONSUL_CACERT.")
+	flag.StringVar(&opts.certFile, "consul.cert-file", "", "File path to a PEM-encoded certificate used with the private key to verify the exporter's authenticity. Overrides $CONSUL_CLIENT_CERT.")
+	flag.StringVar(&opts.keyFile, "consul.key-file", "", "File path to a PEM-encoded private key used with the certificate to verify the exporter's authenticity. Overrides $CONSUL_CLIENT_KEY.")
+	flag.BoolVar(&opts.insecure, "consul.insecure-skip-verify", false, "Disable TLS host verification. Overrides $CONSUL_HTTP_SSL_VERIFY.")
+	flag.DurationVar(&opts.timeout, "consul.timeout", 10*time.Second, "Timeout on the whole set of HTTP requests made to Consul during a scrape, or 0 for none. Keep it below the Prometheus scrape timeout.")
+	flag.DurationVar(&opts.cacheTTL, "consul.cache-ttl", 0, "Serve scrapes from the results of the last one for this long, e.g. for pairs of Prometheus servers. 0 disables caching.")
+	flag.DurationVar(&opts.scrapeInterval, "consul.scrape-interval", 0, "Query Consul in the background at this interval, so that scrapes only serve the latest results. 0 queries Consul on every scrape.")
+	flag.BoolVar(&opts.watch, "consul.watch", false, "Keep the metrics up to date in the background with blocking queries, so that scrapes don't wait for Consul.")
+	flag.IntVar(&opts.retries, "consul.retries", 0, "Number of times to retry the main queries of a scrape after a transient error, within -consul.timeout.")
+	flag.DurationVar(&opts.retryInterval, "consul.retry-interval", 50*time.Millisecond, "Time to wait before the first retry of a query, doubled for every further retry.")
+	flag.StringVar(&opts.userAgent, "consul.user-agent", "consul_exporter/"+version.Version, "User-Agent header to send with every request to Consul.")
+	flag.IntVar(&opts.concurrentRequests, "consul.concurrent-requests", 1, "Number of per-service health queries to run against Consul in parallel.")
+	flag.StringVar(&opts.namespace, "consul.namespace", "", "Consul Enterprise namespace to query, also reported in the namespace label. Leave empty on Consul OSS.")
+	flag.StringVar(&opts.partition, "consul.partition", "", "Consul Enterprise admin partition to query, also reported in the partition label. Leave empty on Consul OSS.")
+	flag.Float64Var(&opts.rateLimit, "consul.rate-limit", 0, "Maximum number of requests per second to send to Consul, for each datacenter. Unlimited when 0.")
+	flag.IntVar(&opts.rateBurst, "consul.rate-burst", 1, "Number of requests that may be sent to Consul at once before -consul.rate-limit kicks in.")
+	flag.IntVar(&opts.maxIdleConns, "consul.max-idle-conns", 0, "Number of idle keep-alive connections to Consul to keep for reuse across scrapes. Defaults to the Consul client's own default.")
+	flag.BoolVar(&opts.allowStale, "consul.allow-stale", false, "Allow any Consul server, not just the leader, to answer queries. Spreads the load at the cost of possibly slightly outdated data.")
+	flag.BoolVar(&opts.requireConsistent, "consul.require-consistent", false, "Require queries to be answered with consistent reads, confirmed by the leader with a quorum.")
+	flag.StringVar(&opts.datacenter, "consul.datacenter", "", "Datacenter to query and to report in the dc label. Defaults to the datacenter of the agent being queried.")
+	datacenters := flag.String("consul.datacenters", "", "Comma-separated list of datacenters to query, each reported in its own dc label. Overrides -consul.datacenter.")
+	allowedTargets := flag.String("consul.allowed-targets", "", "Comma-separated list of Consul addresses that /probe?target= may query. /probe refuses every target when empty.")
+	flag.BoolVar(&expOpts.healthFromState, "consul.health-from-state", false, "Derive the health of services from the single query for all checks instead of querying every service. Misses service instances without checks of their own.")
+	flag.BoolVar(&expOpts.warningAsHealthy, "consul.warning-as-healthy", false, "Count checks in the warning state as passing. The status label of consul_catalog_service_node_status still tells them apart.")
+	flag.StringVar(&expOpts.serviceInclude, "consul.service-include", "", "Regex of the services whose health is queried and exported. Defaults to all services.")
+	flag.StringVar(&expOpts.serviceExclude, "consul.service-exclude", "", "Regex of the services whose health is neither queried nor exported. Takes precedence over -consul.service-include.")
+	flag.StringVar(&expOpts.checkStates, "consul.check-states", "", "Comma-separated check states (passing, warning, critical) for which consul_agent_check and consul_service_check are exported, e.g. critical,warning. Defaults to all states.")
+	flag.StringVar(&expOpts.nodes, "consul.node", "", "Comma-separated nodes whose checks are queried and exported, e.g. the node of a sidecar exporter. Defaults to all nodes.")
+	flag.BoolVar(&expOpts.exposeTags, "consul.expose-tags", false, "Export the tags of every service instance as consul_service_tag series. Adds one series per tag per instance.")
+	flag.BoolVar(&expOpts.exposeCheckOutput, "consul.expose-check-output", false, "Export when each check last changed its status or output as consul_check_last_update. Adds one series per check.")
+	flag.BoolVar(&expOpts.exposeIntentions, "consul.expose-intentions", false, "Export the number of Connect intentions by action as consul_connect_intentions. Needs Connect to be enabled.")
+	flag.BoolVar(&expOpts.exposeCoordinates, "consul.expose-coordinates", false, "Export the round trip time from the queried agent to every node as consul_network_rtt_seconds. Adds one series per node.")
+	flag.BoolVar(&expOpts.exposeRaftLag, "consul.expose-raft-lag", false, "Export the last Raft contact and index of every server as seen by Autopilot, as consul_raft_last_contact_seconds and consul_raft_last_index.")
+	flag.BoolVar(&expOpts.exposeAgentHealth, "consul.expose-agent-health", false, "Export whether all the checks registered with the agent the exporter talks to, and its serfHealth check, are passing, as consul_agent_self_healthy. Meant for an exporter running next to a client agent.")
+	flag.BoolVar(&expOpts.exposeLicense, "consul.expose-license", false, "Export the time left before the Consul Enterprise license expires, as consul_license_expiry_seconds. Fails on Consul OSS.")
+	flag.BoolVar(&expOpts.exposeConnectTopology, "consul.expose-connect-topology", false, "Export which services may call which according to Connect intentions, as consul_connect_topology. Limited to services that pass the service filters.")
+	flag.BoolVar(&expOpts.exposeDatacenters, "consul.expose-datacenters", false, "Export the datacenters known through WAN federation, and whether each of them answers, as consul_catalog_datacenters and consul_datacenter_reachable. Asks every datacenter on every scrape.")
+	flag.BoolVar(&expOpts.exposeDeregisterCritical, "consul.expose-deregister-critical", false, "Export how long critical services have left before Consul deregisters them, as consul_service_deregister_critical_seconds.")
+	flag.StringVar(&expOpts.nodeLabel, "consul.node-label", "name", "What to report in node labels: the node's name, or its id, which survives rebuilding a node under the same name.")
+	flag.StringVar(&expOpts.nodeMetaLabels, "consul.node-meta-labels", "", "Comma-separated node meta keys to export as meta_<key> labels of consul_node_metadata. Not exported when empty.")
+	flag.StringVar(&expOpts.serviceMetaLabels, "consul.service-meta-labels", "", "Comma-separated service meta keys to export as meta_<key> labels of consul_service_metadata. Not exported when empty.")
+	flag.StringVar(&expOpts.agentMetricPrefixes, "consul.agent-metrics-prefixes", "", "Comma-separated prefixes of the agent's own metrics to export as consul_agent_*, e.g. consul.raft.,consul.runtime. Not exported when empty.")
+	flag.Var(&expOpts.kvPrefixes, "kv.prefix", "Prefix from which to expose key/value pairs, optionally followed by =regex to filter its keys. Repeat the flag to expose several prefixes.")
+	flag.StringVar(&expOpts.kvFilter, "kv.filter", ".*", "Regex that determines which keys to expose, for prefixes that don't set their own.")
+	flag.StringVar(&expOpts.kvValueMap, "kv.value-map", "", "Comma-separated value=number pairs used to export non-numeric values, e.g. true=1,false=0.")
+	flag.StringVar(&expOpts.kvMode, "kv.mode", "gauge", "How to export key/value pairs: gauge exports numeric values as consul_catalog_kv, info exports every value as a label of consul_kv_info. Every distinct value adds a series in info mode.")
+	flag.StringVar(&expOpts.kvParseMode, "kv.parse-mode", "float", "How to parse KV values as numbers: float, int (decimal, or hex, octal and binary with a 0x, 0o or 0b prefix; 010 is 10) or auto, which tries int first.")
+	flag.Float64Var(&expOpts.kvMin, "kv.min", math.Inf(-1), "Only export key/value pairs whose value is at least this.")
+	flag.Float64Var(&expOpts.kvMax, "kv.max", math.Inf(1), "Only export key/value pairs whose value is at most this.")
+	configFile := flag.String("config.file", "", "YAML file mapping flag names to their values. Flags given on the command line take precedence.")
 	flag.Parse()
 
-	exporter := NewExporter(*consulServer, *kvPrefix, *kvFilter)
-	prometheus.MustRegister(exporter)
+	if *showVersion {
+		fmt.Fprintln(os.Stdout, version.Print("consul_exporter"))
+		os.Exit(0)
+	}
+
+	if *configFile != "" {
+		if err := loadConfigFile(*configFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading the config file %s: %s\n", *configFile, err)
+			os.Exit(1)
+		}
+	}
+
+	logger := promlog.New(promlogConfig)
+
+	// Keep the password out of the process list if asked to.
+	if *authPassFile != "" {
+		if *authPassword != "" {
+			level.Error(logger).Log("msg", "Only one of -web.auth-password and -web.auth-password-file may be set")
+			os.Exit(1)
+		}
+		password, err := os.ReadFile(*authPassFile)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error reading the basic auth password", "err", err)
+			os.Exit(1)
+		}
+		*authPassword = strings.TrimRight(string(password), "\r\n")
+	}
+	// An empty password would let anyone in who knows the username.
+	if *authUsername != "" && *authPassword == "" {
+		level.Error(logger).Log("msg", "-web.auth-username requires a password from -web.auth-password or -web.auth-password-file")
+		os.Exit(1)
+	}
+
+	// Each datacenter gets an exporter of its own, so that one which can't
+	// be reached only reports itself as down.
+	dcs := splitList(*datacenters)
+	if len(dcs) == 0 {
+		dcs = []string{opts.datacenter}
+	}
+	exporters := &exporterSet{}
+	var pending []consulOpts
+	for _, dc := range dcs {
+		dcOpts := opts
+		dcOpts.datacenter = dc
+		exporter, err := NewExporter(dcOpts, expOpts, logger)
+		switch {
+		case errors.Is(err, errNoDatacenter):
+			// Consul may just not be up yet, so keep trying.
+			level.Error(logger).Log("msg", "Error creating the exporter", "dc", dc, "retry_in", datacenterRetryInterval, "err", err)
+			pending = append(pending, dcOpts)
+		case err != nil:
+			level.Error(logger).Log("msg", "Error creating the exporter", "dc", dc, "err", err)
+			os.Exit(1)
+		default:
+			prometheus.MustRegister(exporter)
+			agentMetricsRegistry.MustRegister(agentMetricsCollector{exporter})
+			exporters.add(exporter)
+		}
+	}
+	prometheus.MustRegister(versioncollector.NewCollector(expOpts.metricsNamespace + "_exporter"))
+
+	level.Info(logger).Log("msg", "Starting consul_exporter", "version", version.Info())
+	level.Info(logger).Log("msg", "Build context", "context", version.BuildContext())
+	// Stop querying Consul in the background before exiting on a signal.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var background sync.WaitGroup
+	run := func(exporter *Exporter) {
+		switch {
+		case opts.watch:
+			background.Add(1)
+			go func() {
+				defer background.Done()
+				exporter.Watch(ctx)
+			}()
+		case opts.scrapeInterval > 0:
+			background.Add(1)
+			go func() {
+				defer background.Done()
+				exporter.ScrapeEvery(ctx, opts.scrapeInterval)
+			}()
+		}
+	}
+	for _, exporter := range exporters.list() {
+		run(exporter)
+	}
+	for _, dcOpts := range pending {
+		background.Add(1)
+		go func(dcOpts consulOpts) {
+			defer background.Done()
+			if exporter := retryNewExporter(ctx, dcOpts, expOpts, logger); exporter != nil {
+				exporters.add(exporter)
+				run(exporter)
+			}
+		}(dcOpts)
+	}
+	go func() {
+		<-ctx.Done()
+		level.Info(logger).Log("msg", "Shutting down")
+		background.Wait()
+		os.Exit(0)
+	}()
 
-	log.Infof("Starting Server: %s", *listenAddress)
-	http.Handle(*metricsPath, prometheus.Handler())
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	level.Info(logger).Log("msg", "Starting Server", "address", *listenAddress)
+	metricsHandler := serviceMetricsHandler(opts, expOpts, exporters, logger)
+	if *authUsername != "" {
+		metricsHandler = basicAuth(metricsHandler, *authUsername, *authPassword)
+	}
+	// Importing pprof registers its handlers on the default mux, so keep
+	// ours separate and only add them when asked to.
+	mux := http.NewServeMux()
+	mux.Handle(*metricsPath, metricsHandler)
+	var probe http.Handler = probeHandler(opts, expOpts, splitList(*allowedTargets), logger)
+	if *authUsername != "" {
+		probe = basicAuth(probe, *authUsername, *authPassword)
+	}
+	mux.Handle("/probe", probe)
+	if *enablePprof {
+		pprofMux := http.NewServeMux()
+		pprofMux.HandleFunc("/debug/pprof/", pprof.Index)
+		pprofMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		pprofMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		pprofMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		pprofMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		var pprofHandler http.Handler = pprofMux
+		if *authUsername != "" {
+			pprofHandler = basicAuth(pprofHandler, *authUsername, *authPassword)
+		}
+		mux.Handle("/debug/pprof/", pprofHandler)
+	}
+	mux.HandleFunc("/-/healthy", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+	mux.HandleFunc("/-/ready", func(w http.ResponseWriter, r *http.Request) {
+		// A datacenter that is down must not keep the others from
+		// being scraped.
+		for _, exporter := range exporters.list() {
+			if exporter.ready.Load() {
+				w.Write([]byte("OK"))
+				return
+			}
+		}
+		http.Error(w, "Consul has not been reached yet", http.StatusServiceUnavailable)
+	})
+	title := html.EscapeString(*pageTitle)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
-             <head><title>Consul Exporter</title></head>
+             <head><title>` + title + `</title></head>
              <body>
-             <h1>Consul Exporter</h1>
+             <h1>` + title + `</h1>
              <p><a href='` + *metricsPath + `'>Metrics</a></p>
              </body>
              </html>`))
 	})
-	log.Fatal(http.ListenAndServe(*listenAddress, nil))
+	var err error
+	switch {
+	case *tlsCertFile != "" && *tlsKeyFile != "":
+		err = http.ListenAndServeTLS(*listenAddress, *tlsCertFile, *tlsKeyFile, mux)
+	case *tlsCertFile != "" || *tlsKeyFile != "":
+		err = errors.New("both -web.tls-cert-file and -web.tls-key-file must be set to serve over HTTPS")
+	default:
+		err = http.ListenAndServe(*listenAddress, mux)
+	}
+	level.Error(logger).Log("msg", "Error starting HTTP server", "err", err)
+	os.Exit(1)
 }
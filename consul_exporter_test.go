@@ -0,0 +1,1286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	consul_api "github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeConsul answers the Consul HTTP API from canned JSON responses. A
+// response for a path and query, such as /v1/agent/members?wan=1, takes
+// precedence over the one for the path alone. Paths without a response
+// answer 404.
+type fakeConsul struct {
+	*httptest.Server
+
+	mtx       sync.Mutex
+	responses map[string]interface{}
+	statuses  map[string]int
+	hangs     map[string]bool
+	hits      map[string]int
+	conns     int
+	// index is returned in X-Consul-Index.
+	index int
+	// released is closed when the test ends, to let hanging requests go.
+	released chan struct{}
+}
+
+func newFakeConsul(t *testing.T) *fakeConsul {
+	f := &fakeConsul{
+		responses: map[string]interface{}{
+			"/v1/agent/self":    map[string]interface{}{"Config": map[string]interface{}{"Datacenter": "dc1", "NodeName": "n1", "Server": true, "Version": "1.17.0"}},
+			"/v1/agent/members": []interface{}{},
+			"/v1/status/peers":  []string{"10.0.0.1:8300"},
+			"/v1/status/leader": "10.0.0.1:8300",
+			"/v1/operator/raft/configuration": map[string]interface{}{
+				"Servers": []map[string]interface{}{{"ID": "a", "Node": "n1", "Address": "10.0.0.1:8300", "Leader": true, "Voter": true}},
+			},
+			"/v1/catalog/nodes":    []map[string]interface{}{{"Node": "n1", "Address": "10.0.0.1"}},
+			"/v1/session/list":     []interface{}{},
+			"/v1/query":            []interface{}{},
+			"/v1/catalog/services": map[string][]string{"web": {}},
+			"/v1/health/service/web": []map[string]interface{}{{
+				"Node":    map[string]interface{}{"Node": "n1", "Address": "10.0.0.1"},
+				"Service": map[string]interface{}{"ID": "web", "Service": "web", "Port": 80},
+				"Checks":  []map[string]interface{}{{"Node": "n1", "CheckID": "service:web", "Status": "passing", "ServiceID": "web", "ServiceName": "web"}},
+			}},
+			"/v1/health/state/any": []map[string]interface{}{
+				{"Node": "n1", "CheckID": "serfHealth", "Status": "passing"},
+				{"Node": "n1", "CheckID": "service:web", "Status": "critical", "ServiceID": "web", "ServiceName": "web"},
+			},
+		},
+		statuses: map[string]int{},
+		hangs:    map[string]bool{},
+		hits:     map[string]int{},
+		released: make(chan struct{}),
+		index:    1,
+	}
+	f.Server = httptest.NewUnstartedServer(http.HandlerFunc(f.serveHTTP))
+	f.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			f.mtx.Lock()
+			f.conns++
+			f.mtx.Unlock()
+		}
+	}
+	f.Start()
+	t.Cleanup(f.Close)
+	t.Cleanup(func() { close(f.released) })
+	return f
+}
+
+func (f *fakeConsul) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mtx.Lock()
+	f.hits[r.URL.Path]++
+	status, failing := f.statuses[r.URL.Path]
+	hanging := f.hangs[r.URL.Path]
+	response, ok := f.responses[r.URL.Path+"?"+r.URL.RawQuery]
+	if !ok {
+		response, ok = f.responses[r.URL.Path]
+	}
+	index := f.index
+	f.mtx.Unlock()
+
+	switch {
+	case hanging:
+		select {
+		case <-r.Context().Done():
+		case <-f.released:
+		}
+	case failing:
+		http.Error(w, http.StatusText(status), status)
+	case !ok:
+		http.NotFound(w, r)
+	default:
+		w.Header().Set("X-Consul-Index", strconv.Itoa(index))
+		w.Header().Set("X-Consul-KnownLeader", "true")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// set replaces the response to path.
+func (f *fakeConsul) set(path string, response interface{}) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.responses[path] = response
+}
+
+// fail makes path answer with status.
+func (f *fakeConsul) fail(path string, status int) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.statuses[path] = status
+}
+
+// heal makes path answer normally again.
+func (f *fakeConsul) heal(path string) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	delete(f.statuses, path)
+	delete(f.hangs, path)
+}
+
+// hang makes path never answer.
+func (f *fakeConsul) hang(path string) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.hangs[path] = true
+}
+
+// connCount returns how many connections were made to f.
+func (f *fakeConsul) connCount() int {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.conns
+}
+
+// hitCount returns how often path was requested.
+func (f *fakeConsul) hitCount(path string) int {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.hits[path]
+}
+
+// testOpts returns the defaults of the command line flags, pointed at uri.
+func testOpts(uri string) (consulOpts, exporterOpts) {
+	return consulOpts{
+		uri:                uri,
+		timeout:            5 * time.Second,
+		concurrentRequests: 1,
+		datacenter:         "dc1",
+		retryInterval:      50 * time.Millisecond,
+		rateBurst:          1,
+	}, exporterOpts{
+		kvFilter:                ".*",
+		metricsNamespace:        defaultNamespace,
+		kvMin:                   math.Inf(-1),
+		kvMax:                   math.Inf(1),
+		kvParseMode:             "float",
+		nodeLabel:               "name",
+		collectKV:               true,
+		collectServiceEntries:   true,
+		collectServiceInstances: true,
+		collectChecks:           true,
+		kvMode:                  "gauge",
+	}
+}
+
+func newTestExporter(t *testing.T, opts consulOpts, expOpts exporterOpts) *Exporter {
+	t.Helper()
+	e, err := NewExporter(opts, expOpts, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// scrape collects c once and returns every sample by name and labels, such
+// as `consul_up` or `consul_catalog_service_nodes{service="web"}`. The dc
+// label is left out.
+func scrape(t *testing.T, c prometheus.Collector) map[string]float64 {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samples := map[string]float64{}
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			var labels []string
+			for _, pair := range m.GetLabel() {
+				if pair.GetName() != "dc" {
+					labels = append(labels, pair.GetName()+`="`+pair.GetValue()+`"`)
+				}
+			}
+			sort.Strings(labels)
+			name := family.GetName()
+			if len(labels) > 0 {
+				name += "{" + strings.Join(labels, ",") + "}"
+			}
+			switch {
+			case m.Gauge != nil:
+				samples[name] = m.GetGauge().GetValue()
+			case m.Counter != nil:
+				samples[name] = m.GetCounter().GetValue()
+			case m.Untyped != nil:
+				samples[name] = m.GetUntyped().GetValue()
+			}
+		}
+	}
+	return samples
+}
+
+func TestScrapeHungConsul(t *testing.T) {
+	// Accept connections, but never answer on them.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	opts, expOpts := testOpts("http://" + listener.Addr().String())
+	opts.timeout = 200 * time.Millisecond
+	e := newTestExporter(t, opts, expOpts)
+
+	start := time.Now()
+	samples := scrape(t, e)
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("scrape took %s with a timeout of %s", took, opts.timeout)
+	}
+	if got := samples["consul_up"]; got != 0 {
+		t.Errorf("consul_up = %g, want 0", got)
+	}
+}
+
+func TestScrapeWithoutTimeout(t *testing.T) {
+	consul := newFakeConsul(t)
+	opts, expOpts := testOpts(consul.URL)
+	opts.timeout = 0
+	e := newTestExporter(t, opts, expOpts)
+
+	if got := scrape(t, e)["consul_up"]; got != 1 {
+		t.Errorf("consul_up = %g, want 1", got)
+	}
+}
+
+func TestNegativeTimeout(t *testing.T) {
+	opts, expOpts := testOpts("http://127.0.0.1:0")
+	opts.timeout = -time.Second
+	if _, err := NewExporter(opts, expOpts, log.NewNopLogger()); err == nil {
+		t.Fatal("NewExporter() with a negative timeout succeeded, want an error")
+	}
+}
+
+func TestServiceCountOnFailedQuery(t *testing.T) {
+	consul := newFakeConsul(t)
+	opts, expOpts := testOpts(consul.URL)
+	e := newTestExporter(t, opts, expOpts)
+
+	if got := scrape(t, e)["consul_catalog_services"]; got != 1 {
+		t.Fatalf("consul_catalog_services = %g, want 1", got)
+	}
+	consul.fail("/v1/catalog/services", http.StatusInternalServerError)
+	if got, ok := scrape(t, e)["consul_catalog_services"]; ok {
+		t.Errorf("consul_catalog_services = %g after a failed query, want it left out", got)
+	}
+}
+
+func TestQueryFailsOnItsOwn(t *testing.T) {
+	queries := []string{"peers", "leader", "raft_configuration", "nodes", "sessions", "services", "health", "checks"}
+	for _, tc := range []struct {
+		path, query string
+		// skipped are the queries that need the failed one.
+		skipped []string
+		// missing are left out when the query fails, kept are exported all
+		// the same.
+		missing, kept []string
+	}{
+		{
+			path: "/v1/status/leader", query: "leader",
+			missing: []string{`consul_raft_leader{address="10.0.0.1:8300"}`},
+			kept:    []string{"consul_serf_lan_members", "consul_catalog_services"},
+		},
+		{
+			path: "/v1/catalog/nodes", query: "nodes",
+			missing: []string{"consul_serf_lan_members"},
+			kept:    []string{"consul_catalog_services", `consul_health_checks{status="passing"}`},
+		},
+		{
+			path: "/v1/session/list", query: "sessions",
+			kept: []string{"consul_serf_lan_members", "consul_catalog_services"},
+		},
+		{
+			path: "/v1/catalog/services", query: "services",
+			skipped: []string{"health"},
+			missing: []string{"consul_catalog_services", `consul_catalog_service_node_healthy{node="n1",service="web"}`},
+			kept:    []string{"consul_serf_lan_members", `consul_health_checks{status="passing"}`, `consul_agent_check{check="serfHealth",node="n1"}`},
+		},
+		{
+			path: "/v1/health/service/web", query: "health",
+			missing: []string{`consul_catalog_service_node_healthy{node="n1",service="web"}`},
+			kept:    []string{"consul_catalog_services", `consul_health_checks{status="passing"}`},
+		},
+		{
+			path: "/v1/health/state/any", query: "checks",
+			missing: []string{`consul_health_checks{status="passing"}`, `consul_agent_check{check="serfHealth",node="n1"}`},
+			kept:    []string{"consul_catalog_services", `consul_catalog_service_node_healthy{node="n1",service="web"}`},
+		},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			consul := newFakeConsul(t)
+			consul.fail(tc.path, http.StatusInternalServerError)
+			opts, expOpts := testOpts(consul.URL)
+			e := newTestExporter(t, opts, expOpts)
+
+			samples := scrape(t, e)
+			if got := samples["consul_up"]; got != 1 {
+				t.Errorf("consul_up = %g, want 1", got)
+			}
+			for _, query := range queries {
+				name := `consul_exporter_query_success{query="` + query + `"}`
+				got, ok := samples[name]
+				switch {
+				case query == tc.query && got != 0:
+					t.Errorf("%s = %g, want 0", name, got)
+				case slices.Contains(tc.skipped, query) && ok:
+					t.Errorf("%s = %g, want it left out", name, got)
+				case query != tc.query && !slices.Contains(tc.skipped, query) && (!ok || got != 1):
+					t.Errorf("%s = %g, want 1", name, got)
+				}
+			}
+			for _, name := range tc.missing {
+				if got, ok := samples[name]; ok {
+					t.Errorf("%s = %g, want it left out", name, got)
+				}
+			}
+			for _, name := range tc.kept {
+				if _, ok := samples[name]; !ok {
+					t.Errorf("%s is missing", name)
+				}
+			}
+		})
+	}
+
+	t.Run("peers", func(t *testing.T) {
+		consul := newFakeConsul(t)
+		consul.fail("/v1/status/peers", http.StatusInternalServerError)
+		opts, expOpts := testOpts(consul.URL)
+		e := newTestExporter(t, opts, expOpts)
+
+		samples := scrape(t, e)
+		if got := samples["consul_up"]; got != 0 {
+			t.Errorf("consul_up = %g, want 0", got)
+		}
+		if got := samples[`consul_exporter_query_success{query="peers"}`]; got != 0 {
+			t.Errorf(`consul_exporter_query_success{query="peers"} = %g, want 0`, got)
+		}
+	})
+}
+
+func TestDescribeMatchesCollect(t *testing.T) {
+	consul := newFakeConsul(t)
+	consul.set("/v1/kv/config", []map[string]interface{}{{"Key": "config/replicas", "Value": "Mw=="}})
+	consul.set("/v1/agent/checks", map[string]interface{}{"service:web": map[string]interface{}{"Node": "n1", "CheckID": "service:web", "Status": "passing"}})
+	consul.set("/v1/health/node/n1", []map[string]interface{}{{"Node": "n1", "CheckID": "serfHealth", "Status": "passing"}})
+	consul.set("/v1/connect/intentions", []map[string]interface{}{{"SourceName": "web", "DestinationName": "db", "Action": "allow"}})
+	consul.set("/v1/coordinate/nodes", []interface{}{})
+	consul.set("/v1/catalog/datacenters", []string{"dc1"})
+	consul.set("/v1/agent/metrics", map[string]interface{}{"Gauges": []map[string]interface{}{{"Name": "consul.runtime.num_goroutines", "Value": 42}}})
+	opts, expOpts := testOpts(consul.URL)
+	expOpts.kvPrefixes.Set("config")
+	expOpts.exposeTags = true
+	expOpts.exposeCheckOutput = true
+	expOpts.nodeMetaLabels = "rack"
+	expOpts.serviceMetaLabels = "version"
+	expOpts.exposeIntentions = true
+	expOpts.exposeCoordinates = true
+	expOpts.exposeRaftLag = true
+	expOpts.exposeDeregisterCritical = true
+	expOpts.exposeAgentHealth = true
+	expOpts.exposeLicense = true
+	expOpts.exposeConnectTopology = true
+	expOpts.exposeDatacenters = true
+	expOpts.agentMetricPrefixes = "consul.runtime."
+	e := newTestExporter(t, opts, expOpts)
+
+	// A pedantic registry fails to gather metrics that weren't described.
+	// The agent metrics, which can't be, are gathered apart, after the
+	// exporter.
+	registry, agentRegistry := prometheus.NewPedanticRegistry(), prometheus.NewPedanticRegistry()
+	registry.MustRegister(e)
+	agentRegistry.MustRegister(agentMetricsCollector{e})
+	expected := `
+# HELP consul_agent_runtime_num_goroutines Metric of the Consul agent.
+# TYPE consul_agent_runtime_num_goroutines gauge
+consul_agent_runtime_num_goroutines{dc="dc1"} 42
+# HELP consul_catalog_kv The values for selected keys in Consul's key/value catalog. Keys with non-numeric values are omitted.
+# TYPE consul_catalog_kv gauge
+consul_catalog_kv{dc="dc1",key="config/replicas"} 3
+# HELP consul_up Was the last query of Consul successful.
+# TYPE consul_up gauge
+consul_up{dc="dc1"} 1
+`
+	gatherer := prometheus.Gatherers{registry, agentRegistry}
+	if err := testutil.GatherAndCompare(gatherer, strings.NewReader(expected), "consul_up", "consul_catalog_kv", "consul_agent_runtime_num_goroutines"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSerfMembers(t *testing.T) {
+	consul := newFakeConsul(t)
+	consul.set("/v1/agent/members", []map[string]interface{}{
+		{"Name": "n1", "Addr": "10.0.0.1", "Status": 1},
+		{"Name": "n2", "Addr": "10.0.0.2", "Status": 1},
+		{"Name": "n3", "Addr": "10.0.0.3", "Status": 3},
+	})
+	consul.set("/v1/agent/members?wan=1", []map[string]interface{}{
+		{"Name": "n1.dc1", "Addr": "10.0.0.1", "Status": 1},
+		{"Name": "s1.dc2", "Addr": "10.1.0.1", "Status": 1},
+	})
+	opts, expOpts := testOpts(consul.URL)
+	e := newTestExporter(t, opts, expOpts)
+
+	samples := scrape(t, e)
+	for name, want := range map[string]float64{
+		"consul_serf_lan_members":                            1,
+		"consul_serf_wan_members":                            2,
+		`consul_exporter_query_success{query="wan_members"}`: 1,
+		`consul_serf_lan_member_status{member="n1"}`:         1,
+		`consul_serf_lan_member_status{member="n2"}`:         1,
+		`consul_serf_lan_member_status{member="n3"}`:         3,
+		`consul_exporter_query_success{query="lan_members"}`: 1,
+	} {
+		if got, ok := samples[name]; !ok || got != want {
+			t.Errorf("%s = %g, want %g", name, got, want)
+		}
+	}
+	for _, member := range []string{"n1.dc1", "s1.dc2"} {
+		name := `consul_serf_lan_member_status{member="` + member + `"}`
+		if got, ok := samples[name]; ok {
+			t.Errorf("%s = %g, want WAN members left out", name, got)
+		}
+	}
+}
+
+func TestConnectionsReused(t *testing.T) {
+	consul := newFakeConsul(t)
+	opts, expOpts := testOpts(consul.URL)
+	opts.maxIdleConns = 4
+	expOpts.exposeAgentHealth = true
+	e := newTestExporter(t, opts, expOpts)
+
+	scrape(t, e)
+	conns := consul.connCount()
+	for i := 0; i < 10; i++ {
+		scrape(t, e)
+	}
+	if got := consul.connCount(); got != conns {
+		t.Errorf("%d connections after 11 scrapes, want the %d of the first one", got, conns)
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	consul := newFakeConsul(t)
+	socket := filepath.Join(t.TempDir(), "http.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(consul.serveHTTP)}
+	go server.Serve(listener)
+	defer server.Close()
+
+	opts, expOpts := testOpts("unix://" + socket)
+	e := newTestExporter(t, opts, expOpts)
+	samples := scrape(t, e)
+	if got := samples["consul_up"]; got != 1 {
+		t.Errorf("consul_up = %g, want 1", got)
+	}
+	if got := samples[`consul_catalog_service_node_healthy{node="n1",service="web"}`]; got != 1 {
+		t.Errorf("web isn't reported healthy over the socket")
+	}
+	if got := samples[`consul_exporter_active_server{server="unix://`+socket+`"}`]; got != 1 {
+		t.Errorf("the socket isn't reported as the active server")
+	}
+}
+
+func TestMidScrapeFailure(t *testing.T) {
+	consul := newFakeConsul(t)
+	opts, expOpts := testOpts(consul.URL)
+	opts.timeout = 300 * time.Millisecond
+	e := newTestExporter(t, opts, expOpts)
+
+	const healthy = `consul_catalog_service_node_healthy{node="n1",service="web"}`
+	samples := scrape(t, e)
+	for _, name := range []string{"consul_raft_peers", "consul_serf_lan_members", healthy} {
+		if _, ok := samples[name]; !ok {
+			t.Fatalf("%s missing from the first scrape", name)
+		}
+	}
+
+	// The cluster-wide queries go through, but the scrape runs out of time
+	// on the health of the services.
+	consul.hang("/v1/health/service/web")
+	samples = scrape(t, e)
+	if got := samples["consul_up"]; got != 0 {
+		t.Errorf("consul_up = %g, want 0", got)
+	}
+	if got := samples["consul_exporter_last_scrape_error"]; got != 1 {
+		t.Errorf("consul_exporter_last_scrape_error = %g, want 1", got)
+	}
+	for name, value := range samples {
+		if !strings.HasPrefix(name, "consul_exporter_") && name != "consul_up" {
+			t.Errorf("%s = %g exported from a scrape that didn't finish", name, value)
+		}
+	}
+
+	consul.heal("/v1/health/service/web")
+	samples = scrape(t, e)
+	if got := samples[healthy]; got != 1 {
+		t.Errorf("%s = %g once Consul answers again, want 1", healthy, got)
+	}
+}
+
+func TestDashedNamesDontCollide(t *testing.T) {
+	// Joined with a dash, both pairs would read "a-b-c".
+	consul := newFakeConsul(t)
+	consul.set("/v1/catalog/services", map[string][]string{"a-b": {}, "a": {}})
+	consul.set("/v1/health/service/a-b", []map[string]interface{}{{
+		"Node":    map[string]interface{}{"Node": "c"},
+		"Service": map[string]interface{}{"ID": "a-b", "Service": "a-b"},
+		"Checks":  []map[string]interface{}{{"Node": "c", "CheckID": "service:a-b", "Status": "passing"}},
+	}})
+	consul.set("/v1/health/service/a", []map[string]interface{}{{
+		"Node":    map[string]interface{}{"Node": "b-c"},
+		"Service": map[string]interface{}{"ID": "a", "Service": "a"},
+		"Checks":  []map[string]interface{}{{"Node": "b-c", "CheckID": "service:a", "Status": "critical"}},
+	}})
+	opts, expOpts := testOpts(consul.URL)
+	e := newTestExporter(t, opts, expOpts)
+
+	samples := scrape(t, e)
+	for name, want := range map[string]float64{
+		`consul_catalog_service_nodes{service="a-b"}`:                 1,
+		`consul_catalog_service_nodes{service="a"}`:                   1,
+		`consul_catalog_service_node_healthy{node="c",service="a-b"}`: 1,
+		`consul_catalog_service_node_healthy{node="b-c",service="a"}`: 0,
+		`consul_node_services{node="c"}`:                              1,
+		`consul_node_services{node="b-c"}`:                            1,
+	} {
+		if got, ok := samples[name]; !ok || got != want {
+			t.Errorf("%s = %g, want %g", name, got, want)
+		}
+	}
+	for _, name := range []string{
+		`consul_catalog_service_node_healthy{node="b-c",service="a-b"}`,
+		`consul_catalog_service_node_healthy{node="c",service="a"}`,
+	} {
+		if got, ok := samples[name]; ok {
+			t.Errorf("%s = %g, want it left out", name, got)
+		}
+	}
+}
+
+func TestServiceInstancesOff(t *testing.T) {
+	consul := newFakeConsul(t)
+	opts, expOpts := testOpts(consul.URL)
+	expOpts.collectServiceInstances = false
+	expOpts.exposeTags = true
+	expOpts.serviceMetaLabels = "version"
+	e := newTestExporter(t, opts, expOpts)
+
+	samples := scrape(t, e)
+	for name, want := range map[string]float64{
+		`consul_catalog_service_nodes{service="web"}`:                  1,
+		`consul_catalog_service_node_healthy{node="n1",service="web"}`: 1,
+	} {
+		if got, ok := samples[name]; !ok || got != want {
+			t.Errorf("%s = %g, want %g", name, got, want)
+		}
+	}
+	for name := range samples {
+		for _, prefix := range []string{"consul_catalog_service_node_status", "consul_service_tag", "consul_service_port", "consul_service_address_info", "consul_service_weight", "consul_service_metadata"} {
+			if strings.HasPrefix(name, prefix+"{") {
+				t.Errorf("%s = %g, want it left out", name, samples[name])
+			}
+		}
+	}
+}
+
+func TestServiceNodeHealthMixedInstances(t *testing.T) {
+	// instance is a web instance on node whose only check has status.
+	instance := func(node, id, status string) map[string]interface{} {
+		return map[string]interface{}{
+			"Node":    map[string]interface{}{"Node": node},
+			"Service": map[string]interface{}{"ID": id, "Service": "web"},
+			"Checks":  []map[string]interface{}{{"Node": node, "CheckID": "service:" + id, "Status": status}},
+		}
+	}
+
+	for _, tc := range []struct {
+		name             string
+		instances        []map[string]interface{}
+		warningAsHealthy bool
+		// healthy and status are by node.
+		healthy   map[string]float64
+		status    map[string]string
+		unhealthy float64
+	}{
+		{
+			name:      "failing before passing",
+			instances: []map[string]interface{}{instance("n1", "web-1", "critical"), instance("n1", "web-2", "passing")},
+			healthy:   map[string]float64{"n1": 0},
+			status:    map[string]string{"n1": "critical"},
+			unhealthy: 1,
+		},
+		{
+			name:      "passing before failing",
+			instances: []map[string]interface{}{instance("n1", "web-1", "passing"), instance("n1", "web-2", "critical")},
+			healthy:   map[string]float64{"n1": 0},
+			status:    map[string]string{"n1": "critical"},
+			unhealthy: 1,
+		},
+		{
+			name:      "warning only",
+			instances: []map[string]interface{}{instance("n1", "web-1", "warning"), instance("n1", "web-2", "warning")},
+			healthy:   map[string]float64{"n1": 0},
+			status:    map[string]string{"n1": "warning"},
+			unhealthy: 2,
+		},
+		{
+			name:             "warning only, counted as healthy",
+			instances:        []map[string]interface{}{instance("n1", "web-1", "warning"), instance("n1", "web-2", "warning")},
+			warningAsHealthy: true,
+			healthy:          map[string]float64{"n1": 1},
+			status:           map[string]string{"n1": "warning"},
+			unhealthy:        0,
+		},
+		{
+			name: "one mixed node, one healthy",
+			instances: []map[string]interface{}{
+				instance("n1", "web-1", "passing"), instance("n1", "web-2", "warning"), instance("n1", "web-3", "passing"),
+				instance("n2", "web-4", "passing"), instance("n2", "web-5", "passing"),
+			},
+			healthy:   map[string]float64{"n1": 0, "n2": 1},
+			status:    map[string]string{"n1": "warning", "n2": "passing"},
+			unhealthy: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			consul := newFakeConsul(t)
+			consul.set("/v1/health/service/web", tc.instances)
+			opts, expOpts := testOpts(consul.URL)
+			expOpts.warningAsHealthy = tc.warningAsHealthy
+			e := newTestExporter(t, opts, expOpts)
+
+			samples := scrape(t, e)
+			for node, want := range tc.healthy {
+				name := `consul_catalog_service_node_healthy{node="` + node + `",service="web"}`
+				if got, ok := samples[name]; !ok || got != want {
+					t.Errorf("%s = %g, want %g", name, got, want)
+				}
+				if got := samples[`consul_node_services{node="`+node+`"}`]; got != 1 {
+					t.Errorf("consul_node_services for %s = %g, want 1", node, got)
+				}
+				for _, status := range healthStatuses {
+					name := `consul_catalog_service_node_status{node="` + node + `",service="web",status="` + status + `"}`
+					want := 0.0
+					if status == tc.status[node] {
+						want = 1
+					}
+					if got := samples[name]; got != want {
+						t.Errorf("%s = %g, want %g", name, got, want)
+					}
+				}
+			}
+			if got := samples["consul_catalog_unhealthy_service_instances"]; got != tc.unhealthy {
+				t.Errorf("consul_catalog_unhealthy_service_instances = %g, want %g", got, tc.unhealthy)
+			}
+			if got := samples[`consul_catalog_service_nodes{service="web"}`]; got != float64(len(tc.instances)) {
+				t.Errorf(`consul_catalog_service_nodes{service="web"} = %g, want %d`, got, len(tc.instances))
+			}
+		})
+	}
+}
+
+func TestEmptyPeers(t *testing.T) {
+	consul := newFakeConsul(t)
+	consul.set("/v1/status/peers", []string{})
+	opts, expOpts := testOpts(consul.URL)
+	e := newTestExporter(t, opts, expOpts)
+
+	samples := scrape(t, e)
+	for name, want := range map[string]float64{
+		"consul_up":         1,
+		"consul_raft_peers": 0,
+		`consul_exporter_query_success{query="peers"}`: 1,
+	} {
+		if got, ok := samples[name]; !ok || got != want {
+			t.Errorf("%s = %g, want %g", name, got, want)
+		}
+	}
+	if _, ok := samples[`consul_catalog_service_node_healthy{node="n1",service="web"}`]; !ok {
+		t.Error("the rest of the scrape was skipped")
+	}
+}
+
+func TestKeyValuesEmptyPrefixVersusError(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		status  int
+		success float64
+		keys    bool
+		errors  float64
+	}{
+		{name: "empty", status: 0, success: 1, keys: true, errors: 0},
+		{name: "forbidden", status: http.StatusForbidden, success: 0, keys: false, errors: 1},
+		{name: "failing", status: http.StatusInternalServerError, success: 0, keys: false, errors: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			consul := newFakeConsul(t)
+			if tc.status != 0 {
+				consul.fail("/v1/kv/config", tc.status)
+			}
+			opts, expOpts := testOpts(consul.URL)
+			expOpts.kvPrefixes.Set("config")
+			e := newTestExporter(t, opts, expOpts)
+
+			samples := scrape(t, e)
+			if got := samples[`consul_catalog_kv_list_success{prefix="config"}`]; got != tc.success {
+				t.Errorf("consul_catalog_kv_list_success = %g, want %g", got, tc.success)
+			}
+			if got := samples[`consul_exporter_query_success{query="kv"}`]; got != tc.success {
+				t.Errorf(`consul_exporter_query_success{query="kv"} = %g, want %g`, got, tc.success)
+			}
+			if got := samples[`consul_exporter_scrape_errors_total{query="kv"}`]; got != tc.errors {
+				t.Errorf(`consul_exporter_scrape_errors_total{query="kv"} = %g, want %g`, got, tc.errors)
+			}
+			got, ok := samples[`consul_catalog_kv_keys{prefix="config"}`]
+			switch {
+			case tc.keys && (!ok || got != 0):
+				t.Errorf("consul_catalog_kv_keys = %g, want 0", got)
+			case !tc.keys && ok:
+				t.Errorf("consul_catalog_kv_keys = %g, want it left out", got)
+			}
+		})
+	}
+}
+
+func TestHealthChecksSurviveClosedChannels(t *testing.T) {
+	consul := newFakeConsul(t)
+	opts, expOpts := testOpts(consul.URL)
+	e := newTestExporter(t, opts, expOpts)
+
+	for i := 0; i < 50; i++ {
+		samples := scrape(t, e)
+		for status, want := range map[string]float64{"passing": 1, "critical": 1, "warning": 0} {
+			name := `consul_health_checks{status="` + status + `"}`
+			if got := samples[name]; got != want {
+				t.Fatalf("scrape %d: %s = %g, want %g", i, name, got, want)
+			}
+		}
+	}
+}
+
+func TestCheckUpdatesKeptAcrossScrapes(t *testing.T) {
+	consul := newFakeConsul(t)
+	opts, expOpts := testOpts(consul.URL)
+	expOpts.exposeCheckOutput = true
+	e := newTestExporter(t, opts, expOpts)
+
+	scrape(t, e)
+	key := checkKey{node: "n1", check: "serfHealth"}
+	first, ok := e.checkUpdates[key]
+	if !ok {
+		t.Fatalf("no update recorded for %v", key)
+	}
+	for i := 0; i < 10; i++ {
+		scrape(t, e)
+		if got := e.checkUpdates[key]; got != first {
+			t.Fatalf("scrape %d: update for %v = %v, want %v", i, key, got, first)
+		}
+	}
+}
+
+func TestDeregisterCriticalCountsDown(t *testing.T) {
+	consul := newFakeConsul(t)
+	consul.set("/v1/health/state/any", []map[string]interface{}{{
+		"Node": "n1", "CheckID": "service:web", "Status": "critical", "ServiceID": "web", "ServiceName": "web",
+		"Definition": map[string]interface{}{"DeregisterCriticalServiceAfter": "1h"},
+	}})
+	opts, expOpts := testOpts(consul.URL)
+	expOpts.exposeDeregisterCritical = true
+	e := newTestExporter(t, opts, expOpts)
+
+	const name = `consul_service_deregister_critical_seconds{check="service:web",node="n1",service="web"}`
+	last := scrape(t, e)[name]
+	if last <= 0 || last > time.Hour.Seconds() {
+		t.Fatalf("%s = %g, want within (0, 3600]", name, last)
+	}
+	for i := 0; i < 10; i++ {
+		time.Sleep(time.Millisecond)
+		got := scrape(t, e)[name]
+		if got >= last {
+			t.Fatalf("scrape %d: %s = %g, want less than %g", i, name, got, last)
+		}
+		last = got
+	}
+}
+
+// eventually fails t unless cond holds within a few seconds.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatchFailsOver(t *testing.T) {
+	first, second := newFakeConsul(t), newFakeConsul(t)
+	opts, expOpts := testOpts(first.URL + "," + second.URL)
+	opts.watch = true
+	e := newTestExporter(t, opts, expOpts)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.Watch(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	eventually(t, "consul_up 1", func() bool { return scrape(t, e)["consul_up"] == 1 })
+
+	first.Close()
+	eventually(t, "the watch to fail over", func() bool { return second.hitCount("/v1/health/state/any") > 0 })
+	if got := scrape(t, e)["consul_up"]; got != 1 {
+		t.Errorf("consul_up = %g after failing over, want 1", got)
+	}
+
+	second.Close()
+	eventually(t, "consul_up 0", func() bool { return scrape(t, e)["consul_up"] == 0 })
+}
+
+func TestScrapesDontWaitForRefresh(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		set  func(*consulOpts)
+		run  func(*Exporter, context.Context)
+	}{
+		{
+			name: "watch",
+			set:  func(opts *consulOpts) { opts.watch = true },
+			run:  (*Exporter).Watch,
+		},
+		{
+			name: "scrape-interval",
+			set:  func(opts *consulOpts) { opts.scrapeInterval = 50 * time.Millisecond },
+			run:  func(e *Exporter, ctx context.Context) { e.ScrapeEvery(ctx, 50*time.Millisecond) },
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			consul := newFakeConsul(t)
+			opts, expOpts := testOpts(consul.URL)
+			opts.timeout = 2 * time.Second
+			tc.set(&opts)
+			e := newTestExporter(t, opts, expOpts)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				tc.run(e, ctx)
+			}()
+			defer func() {
+				cancel()
+				<-done
+			}()
+
+			eventually(t, "consul_up 1", func() bool { return scrape(t, e)["consul_up"] == 1 })
+
+			// Hold up the next refresh on its first query.
+			consul.hang("/v1/status/peers")
+			hits := consul.hitCount("/v1/status/peers")
+			eventually(t, "a refresh to hang", func() bool { return consul.hitCount("/v1/status/peers") > hits })
+
+			start := time.Now()
+			samples := scrape(t, e)
+			if took := time.Since(start); took > opts.timeout/2 {
+				t.Errorf("scrape took %s during a refresh", took)
+			}
+			if got := samples["consul_up"]; got != 1 {
+				t.Errorf("consul_up = %g during a refresh, want 1 from the last one", got)
+			}
+		})
+	}
+}
+
+func TestAgentQueriesRespectTimeout(t *testing.T) {
+	for _, path := range []string{"/v1/agent/members", "/v1/agent/self", "/v1/agent/checks", "/v1/agent/metrics", "/v1/catalog/datacenters"} {
+		t.Run(path, func(t *testing.T) {
+			consul := newFakeConsul(t)
+			opts, expOpts := testOpts(consul.URL)
+			opts.timeout = 200 * time.Millisecond
+			expOpts.exposeAgentHealth = true
+			expOpts.agentMetricPrefixes = "consul.raft"
+			expOpts.exposeDatacenters = true
+			e := newTestExporter(t, opts, expOpts)
+			consul.hang(path)
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				scrape(t, e)
+			}()
+			select {
+			case <-done:
+			case <-time.After(2 * time.Second):
+				t.Fatalf("scrape still running 2s in with a timeout of %s", opts.timeout)
+			}
+		})
+	}
+}
+
+func TestAgentHealthIncludesSerfHealth(t *testing.T) {
+	consul := newFakeConsul(t)
+	consul.set("/v1/agent/checks", map[string]interface{}{"service:web": map[string]interface{}{"Node": "n1", "CheckID": "service:web", "Status": "passing"}})
+	consul.set("/v1/health/node/n1", []map[string]interface{}{
+		{"Node": "n1", "CheckID": "serfHealth", "Status": "critical"},
+		{"Node": "n1", "CheckID": "service:web", "Status": "passing"},
+	})
+	opts, expOpts := testOpts(consul.URL)
+	expOpts.exposeAgentHealth = true
+	e := newTestExporter(t, opts, expOpts)
+
+	if got := scrape(t, e)["consul_agent_self_healthy"]; got != 0 {
+		t.Errorf("consul_agent_self_healthy = %g with serfHealth critical, want 0", got)
+	}
+
+	consul.set("/v1/health/node/n1", []map[string]interface{}{{"Node": "n1", "CheckID": "serfHealth", "Status": "passing"}})
+	samples := scrape(t, e)
+	if got := samples["consul_agent_self_healthy"]; got != 1 {
+		t.Errorf("consul_agent_self_healthy = %g with serfHealth passing, want 1", got)
+	}
+	if got := samples[`consul_exporter_query_success{query="agent_node_checks"}`]; got != 1 {
+		t.Errorf(`consul_exporter_query_success{query="agent_node_checks"} = %g, want 1`, got)
+	}
+}
+
+func TestCacheIgnoresForbiddenQueries(t *testing.T) {
+	consul := newFakeConsul(t)
+	consul.fail("/v1/operator/autopilot/health", http.StatusForbidden)
+	consul.fail("/v1/operator/raft/configuration", http.StatusForbidden)
+	opts, expOpts := testOpts(consul.URL)
+	opts.cacheTTL = time.Minute
+	e := newTestExporter(t, opts, expOpts)
+
+	for i := 0; i < 3; i++ {
+		samples := scrape(t, e)
+		if got := samples["consul_exporter_last_scrape_error"]; got != 0 {
+			t.Errorf("scrape %d: consul_exporter_last_scrape_error = %g, want 0", i, got)
+		}
+		if got := samples[`consul_exporter_query_success{query="autopilot"}`]; got != 0 {
+			t.Errorf(`scrape %d: consul_exporter_query_success{query="autopilot"} = %g, want 0`, i, got)
+		}
+	}
+	if got := consul.hitCount("/v1/status/peers"); got != 1 {
+		t.Errorf("Consul was queried %d times for 3 scrapes, want 1", got)
+	}
+}
+
+func TestPreparedQueriesForbidden(t *testing.T) {
+	consul := newFakeConsul(t)
+	consul.fail("/v1/query", http.StatusForbidden)
+	opts, expOpts := testOpts(consul.URL)
+	e := newTestExporter(t, opts, expOpts)
+
+	samples := scrape(t, e)
+	for _, name := range []string{
+		"consul_prepared_queries",
+		`consul_exporter_query_success{query="prepared_queries"}`,
+		`consul_exporter_scrape_errors_total{query="prepared_queries"}`,
+	} {
+		if got, ok := samples[name]; ok {
+			t.Errorf("%s = %g, want it left out", name, got)
+		}
+	}
+	if got := samples["consul_exporter_last_scrape_error"]; got != 0 {
+		t.Errorf("consul_exporter_last_scrape_error = %g, want 0", got)
+	}
+}
+
+func TestIntentionsForbidden(t *testing.T) {
+	consul := newFakeConsul(t)
+	consul.fail("/v1/connect/intentions", http.StatusForbidden)
+	opts, expOpts := testOpts(consul.URL)
+	expOpts.exposeIntentions = true
+	e := newTestExporter(t, opts, expOpts)
+
+	samples := scrape(t, e)
+	for _, name := range []string{
+		`consul_connect_intentions{action="allow"}`,
+		`consul_exporter_query_success{query="intentions"}`,
+		`consul_exporter_scrape_errors_total{query="intentions"}`,
+	} {
+		if got, ok := samples[name]; ok {
+			t.Errorf("%s = %g, want it left out", name, got)
+		}
+	}
+	if got := samples["consul_exporter_last_scrape_error"]; got != 0 {
+		t.Errorf("consul_exporter_last_scrape_error = %g, want 0", got)
+	}
+}
+
+func TestProbeSlowTargetDoesntBlockOthers(t *testing.T) {
+	slow, fast := newFakeConsul(t), newFakeConsul(t)
+	slow.hang("/v1/agent/self")
+	opts, expOpts := testOpts("")
+	handler := probeHandler(opts, expOpts, []string{slow.URL, fast.URL}, log.NewNopLogger())
+
+	go handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/probe?target="+slow.URL, nil))
+	eventually(t, "the slow target to be probed", func() bool { return slow.hitCount("/v1/agent/self") > 0 })
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/probe?target="+fast.URL, nil))
+		done <- w
+	}()
+	select {
+	case w := <-done:
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `consul_up{dc="dc1"} 1`) {
+			t.Errorf("probing the fast target returned %d:\n%s", w.Code, w.Body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("probing the fast target waited for the slow one")
+	}
+}
+
+func TestServiceScopedMetrics(t *testing.T) {
+	consul := newFakeConsul(t)
+	opts, expOpts := testOpts(consul.URL)
+	e := newTestExporter(t, opts, expOpts)
+	handler := serviceMetricsHandler(opts, expOpts, &exporterSet{exporters: []*Exporter{e}}, log.NewNopLogger())
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics?service=web", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200:\n%s", w.Code, w.Body)
+	}
+	for _, want := range []string{`consul_up{dc="dc1"} 1`, `consul_catalog_service_node_healthy{dc="dc1",node="n1",service="web"} 1`} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("missing %s in:\n%s", want, w.Body)
+		}
+	}
+	for path, want := range map[string]int{
+		"/v1/health/service/web":          1,
+		"/v1/catalog/services":            0,
+		"/v1/catalog/nodes":               0,
+		"/v1/health/state/any":            0,
+		"/v1/operator/raft/configuration": 0,
+		"/v1/agent/members":               0,
+	} {
+		if got := consul.hitCount(path); got != want {
+			t.Errorf("%s was queried %d times, want %d", path, got, want)
+		}
+	}
+
+	scoped, err := e.scopedTo(opts, expOpts, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scoped.servers[0].client != e.servers[0].client {
+		t.Error("the scoped exporter doesn't share the clients of the main one")
+	}
+}
+
+func TestRetryNewExporter(t *testing.T) {
+	consul := newFakeConsul(t)
+	consul.fail("/v1/agent/self", http.StatusInternalServerError)
+	opts, expOpts := testOpts(consul.URL)
+	opts.datacenter = ""
+	if _, err := NewExporter(opts, expOpts, log.NewNopLogger()); !errors.Is(err, errNoDatacenter) {
+		t.Fatalf("NewExporter() = %v, want %v", err, errNoDatacenter)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	created := make(chan *Exporter)
+	go func() {
+		created <- retryNewExporter(ctx, opts, expOpts, log.NewNopLogger())
+	}()
+
+	eventually(t, "consul_up 0 with an empty dc label", func() bool {
+		families, err := prometheus.DefaultGatherer.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, family := range families {
+			if family.GetName() == "consul_up" {
+				m := family.GetMetric()[0]
+				return len(m.GetLabel()) == 1 && m.GetLabel()[0].GetValue() == "" && m.GetGauge().GetValue() == 0
+			}
+		}
+		return false
+	})
+
+	consul.heal("/v1/agent/self")
+	select {
+	case e := <-created:
+		defer prometheus.Unregister(e)
+		if e.datacenter != "dc1" {
+			t.Errorf("datacenter = %q, want dc1", e.datacenter)
+		}
+		if got := scrape(t, e)["consul_up"]; got != 1 {
+			t.Errorf("consul_up = %g, want 1", got)
+		}
+	case <-time.After(2 * datacenterRetryInterval):
+		t.Fatal("the exporter wasn't created once the agent answered")
+	}
+}
+
+func TestParseKVValue(t *testing.T) {
+	for _, tc := range []struct {
+		mode, value string
+		want        float64
+		fails       bool
+	}{
+		{mode: "int", value: "10", want: 10},
+		{mode: "int", value: "010", want: 10},
+		{mode: "int", value: "-010", want: -10},
+		{mode: "int", value: "0", want: 0},
+		{mode: "int", value: "0x1f", want: 31},
+		{mode: "int", value: "0X1F", want: 31},
+		{mode: "int", value: "-0x1f", want: -31},
+		{mode: "int", value: "0o10", want: 8},
+		{mode: "int", value: "+0b101", want: 5},
+		{mode: "int", value: "1.5", fails: true},
+		{mode: "int", value: "08", want: 8},
+		{mode: "auto", value: "010", want: 10},
+		{mode: "auto", value: "0x10", want: 16},
+		{mode: "auto", value: "1.5", want: 1.5},
+		{mode: "auto", value: "1e3", want: 1000},
+		{mode: "float", value: "010", want: 10},
+		{mode: "float", value: "on", fails: true},
+	} {
+		got, err := parseKVValue(tc.mode, tc.value)
+		switch {
+		case tc.fails && err == nil:
+			t.Errorf("parseKVValue(%q, %q) = %g, want an error", tc.mode, tc.value, got)
+		case !tc.fails && (err != nil || got != tc.want):
+			t.Errorf("parseKVValue(%q, %q) = %g, %v, want %g", tc.mode, tc.value, got, err, tc.want)
+		}
+	}
+}
+
+func TestWatchNeverWaitsOnIndexZero(t *testing.T) {
+	consul := newFakeConsul(t)
+	consul.index = 0
+	var mtx sync.Mutex
+	var indexes []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/catalog/services" {
+			mtx.Lock()
+			indexes = append(indexes, r.URL.Query().Get("index"))
+			mtx.Unlock()
+		}
+		consul.serveHTTP(w, r)
+	}))
+	defer server.Close()
+
+	opts, expOpts := testOpts(server.URL)
+	opts.watch = true
+	e := newTestExporter(t, opts, expOpts)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.watchIndex(ctx, "services", make(chan struct{}, 1), func(client *consul_api.Client, q *consul_api.QueryOptions) (*consul_api.QueryMeta, error) {
+			_, meta, err := client.Catalog().Services(q)
+			return meta, err
+		})
+	}()
+	eventually(t, "a few watch requests", func() bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return len(indexes) >= 3
+	})
+	cancel()
+	<-done
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	// Only the first request goes without an index.
+	for i, index := range indexes[1:] {
+		if index == "" || index == "0" {
+			t.Fatalf("request %d waited on index %q", i+1, index)
+		}
+	}
+}
+
+func TestDatacenterPingsComeLast(t *testing.T) {
+	consul := newFakeConsul(t)
+	consul.set("/v1/catalog/datacenters", []string{"dc1", "dc2"})
+	var mtx sync.Mutex
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		requests = append(requests, r.URL.Path+"?dc="+r.URL.Query().Get("dc"))
+		mtx.Unlock()
+		// dc2 never answers.
+		if r.URL.Query().Get("dc") == "dc2" {
+			<-r.Context().Done()
+			return
+		}
+		consul.serveHTTP(w, r)
+	}))
+	defer server.Close()
+
+	opts, expOpts := testOpts(server.URL)
+	opts.timeout = 400 * time.Millisecond
+	expOpts.exposeDatacenters = true
+	e := newTestExporter(t, opts, expOpts)
+
+	samples := scrape(t, e)
+	for name, want := range map[string]float64{
+		"consul_up": 1,
+		`consul_datacenter_reachable{datacenter="dc1"}`:                1,
+		`consul_datacenter_reachable{datacenter="dc2"}`:                0,
+		`consul_catalog_service_node_healthy{node="n1",service="web"}`: 1,
+		"consul_exporter_last_scrape_error":                            0,
+	} {
+		if got, ok := samples[name]; !ok || got != want {
+			t.Errorf("%s = %g, want %g", name, got, want)
+		}
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	pinged := slices.Index(requests, "/v1/status/leader?dc=dc2")
+	checked := slices.Index(requests, "/v1/health/state/any?dc=dc1")
+	if checked < 0 || pinged < checked {
+		t.Errorf("dc2 was pinged before the checks were queried: %v", requests)
+	}
+}